@@ -0,0 +1,136 @@
+package certify
+
+import (
+	"crypto/x509"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const defaultBatchMaxNames = 100
+
+// SANBatch configures a single certificate covering
+// many server names. Whenever a server name is added to
+// the batch, a new certificate including all names in
+// the batch is requested from the Issuer.
+type SANBatch struct {
+	// Names is the initial set of server names
+	// covered by the batch certificate.
+	Names []string
+
+	// Discover configures whether server names not in Names
+	// should be added to the batch as they are requested,
+	// causing the batch certificate to be reissued.
+	// Until the new certificate is issued, the previous one is
+	// still served for the names it covers.
+	// The HostPolicy is applied before names are added.
+	Discover bool
+
+	// MaxNames is the upper bound of server names covered
+	// by the batch certificate. Once reached, server names
+	// not already in the batch are issued separate certificates.
+	// The CommonName is not counted. Defaults to 100.
+	MaxNames int
+}
+
+// nameBatch tracks the server names covered
+// by a batch certificate.
+type nameBatch struct {
+	discover bool
+	maxNames int
+
+	mu    sync.Mutex
+	names map[string]struct{}
+	// gen is incremented every time a name is added,
+	// so that issuance of different sets of names
+	// is not de-duplicated.
+	gen uint64
+}
+
+func newNameBatch(b *SANBatch) *nameBatch {
+	nb := &nameBatch{
+		discover: b.Discover,
+		maxNames: b.MaxNames,
+		names:    map[string]struct{}{},
+	}
+	if nb.maxNames <= 0 {
+		nb.maxNames = defaultBatchMaxNames
+	}
+	for _, name := range b.Names {
+		nb.names[normalizeHost(name)] = struct{}{}
+	}
+	return nb
+}
+
+// add reports whether name is covered by the batch,
+// adding it if discovery is enabled and there is room.
+func (nb *nameBatch) add(name string) bool {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	if _, ok := nb.names[name]; ok {
+		return true
+	}
+	if !nb.discover || len(nb.names) >= nb.maxNames {
+		return false
+	}
+	nb.names[name] = struct{}{}
+	nb.gen++
+	return true
+}
+
+// request returns the certRequest for the current set of names,
+// for which a cached certificate must cover the requested names.
+func (nb *nameBatch) request(commonName string, cover ...string) certRequest {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	names := make([]string, 0, len(nb.names))
+	for name := range nb.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := commonName + "+batch"
+	return certRequest{
+		key:   key,
+		group: key + "#" + strconv.FormatUint(nb.gen, 10),
+		names: names,
+		cover: cover,
+	}
+}
+
+// coversNames reports whether leaf is valid for all names.
+func coversNames(leaf *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			if !containsIP(leaf.IPAddresses, ip) {
+				return false
+			}
+			continue
+		}
+		if !containsString(leaf.DNSNames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
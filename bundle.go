@@ -0,0 +1,144 @@
+package certify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/johanbrandhorst/certify/internal/keys"
+)
+
+const (
+	bundleBlockType    = "CERTIFY BUNDLE"
+	bundleVersion      = "1"
+	sealedKeyBlockType = "CERTIFY SEALED PRIVATE KEY"
+)
+
+// EncodeBundle encodes a certificate, its chain and private key
+// into a single PEM encoded bundle. The bundle starts with a
+// "CERTIFY BUNDLE" block holding metadata in its headers,
+// followed by the private key and the certificate chain.
+// Tools reading PEM files skip the metadata block, so the bundle
+// can be used wherever a combined key and certificate file is
+// expected. If the private key is a SealedKey, as stored by
+// EncryptedCache, it is encoded in a "CERTIFY SEALED PRIVATE KEY"
+// block instead.
+//
+// It is used by DirCache, and can be used by other Cache
+// implementations to store certificates. The certificate
+// can be decoded with DecodeBundle.
+func EncodeBundle(cert *tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate has no chain")
+	}
+	var keyPEM []byte
+	if sealed, ok := cert.PrivateKey.(*SealedKey); ok {
+		keyPEM = pem.EncodeToMemory(&pem.Block{
+			Type: sealedKeyBlockType,
+			Headers: map[string]string{
+				"Key-Id": sealed.KeyID,
+			},
+			Bytes: sealed.Ciphertext,
+		})
+	} else {
+		var err error
+		keyPEM, err = keys.Marshal(cert.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	err := pem.Encode(&buf, &pem.Block{
+		Type: bundleBlockType,
+		Headers: map[string]string{
+			"Version": bundleVersion,
+			"Created": time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(keyPEM)
+	for _, c := range cert.Certificate {
+		err = pem.Encode(&buf, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeBundle decodes a bundle encoded with EncodeBundle.
+// It validates that the private key matches the leaf
+// certificate, and populates the Leaf of the certificate.
+// If the private key is a SealedKey, it is returned as is,
+// and must be validated once it has been decrypted.
+func DecodeBundle(data []byte) (*tls.Certificate, error) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != bundleBlockType {
+		return nil, errors.New("missing certificate bundle header")
+	}
+	if v := block.Headers["Version"]; v != bundleVersion {
+		return nil, fmt.Errorf("unsupported certificate bundle version %q", v)
+	}
+
+	if bytes.Contains(rest, []byte("-----BEGIN "+sealedKeyBlockType+"-----")) {
+		return decodeSealedBundle(rest)
+	}
+
+	// X509KeyPair skips blocks of other types when looking
+	// for the certificates and the key, and validates
+	// that the key matches the leaf certificate.
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// decodeSealedBundle decodes the blocks
+// of a bundle with a sealed private key.
+func decodeSealedBundle(data []byte) (*tls.Certificate, error) {
+	cert := &tls.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case sealedKeyBlockType:
+			cert.PrivateKey = &SealedKey{
+				KeyID:      block.Headers["Key-Id"],
+				Ciphertext: block.Bytes,
+			}
+		case "CERTIFICATE":
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate bundle has no certificates")
+	}
+
+	var err error
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
@@ -4,20 +4,28 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sync"
-
-	"github.com/johanbrandhorst/certify/internal/keys"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
+	bundleExt = ".pem"
+	// Used by earlier versions of DirCache
 	keyExt  = ".key"
 	certExt = ".crt"
+	// Prefix of the temporary files written by DirCache.Put
+	tmpPrefix = ".tmp-"
 )
 
 // Cache describes the interface that certificate caches must implement.
@@ -36,78 +44,115 @@ type Cache interface {
 }
 
 // ErrCacheMiss should be returned by Cache implementations
-// when a certificate could not be found.
+// when a certificate could not be found. It may be wrapped
+// to add details, so use errors.Is to check for it.
 var ErrCacheMiss = errors.New("no matching certificate found")
 
-type memCache struct {
-	mu    *sync.RWMutex
-	cache map[string]*tls.Certificate
+// ListableCache describes the interface of caches
+// that can enumerate the certificates they store, for
+// example to schedule renewals or take inventory.
+// Use a type assertion to check whether a Cache supports it.
+// ListableCache implementations must be thread safe.
+type ListableCache interface {
+	Cache
+
+	// List returns the certificates stored in the
+	// cache, ordered by the names they are stored under.
+	// Certificates that Get would not return, because
+	// they can't be parsed, are skipped.
+	List(context.Context) ([]CacheEntry, error)
 }
 
-// NewMemCache creates an in-memory cache that implements the Cache interface.
-func NewMemCache() Cache {
-	return &memCache{
-		mu:    &sync.RWMutex{},
-		cache: map[string]*tls.Certificate{},
-	}
+// CacheEntry describes a certificate stored in a ListableCache.
+type CacheEntry struct {
+	// Name is the name the certificate is stored under.
+	Name string
+	// SerialNumber is the serial number of the leaf certificate.
+	SerialNumber *big.Int
+	// Issuer is the issuer of the leaf certificate.
+	Issuer pkix.Name
+	// NotBefore and NotAfter are the bounds
+	// of the validity of the leaf certificate.
+	NotBefore, NotAfter time.Time
+	// DNSNames, IPAddresses and URIs are the Subject
+	// Alternative Names of the leaf certificate.
+	DNSNames    []string
+	IPAddresses []net.IP
+	URIs        []*url.URL
 }
 
-func (m memCache) Get(_ context.Context, key string) (*tls.Certificate, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	cert, ok := m.cache[key]
-	if ok {
-		return cert, nil
+// newCacheEntry describes the certificate stored under the name.
+func newCacheEntry(name string, cert *tls.Certificate) (CacheEntry, bool) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return CacheEntry{}, false
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return CacheEntry{}, false
+		}
 	}
-
-	return nil, ErrCacheMiss
+	return CacheEntry{
+		Name:         name,
+		SerialNumber: leaf.SerialNumber,
+		Issuer:       leaf.Issuer,
+		NotBefore:    leaf.NotBefore,
+		NotAfter:     leaf.NotAfter,
+		DNSNames:     leaf.DNSNames,
+		IPAddresses:  leaf.IPAddresses,
+		URIs:         leaf.URIs,
+	}, true
 }
 
-func (m *memCache) Put(_ context.Context, key string, cert *tls.Certificate) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	m.cache[key] = cert
-	return nil
-}
-
-func (m *memCache) Delete(_ context.Context, key string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	delete(m.cache, key)
-	return nil
+func sortEntries(entries []CacheEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
 }
 
 // DirCache implements Cache using a directory on the local filesystem.
 // If the directory does not exist, it will be created with 0700 permissions.
 //
+// Each certificate is stored with its chain and private key in a single
+// bundle file, see EncodeBundle. Bundle files are written to a temporary
+// file and synced to disk before being renamed into place, so a crash
+// never leaves a partially written or mismatched certificate behind.
+// Certificates stored in separate key and certificate files by earlier
+// versions of DirCache are still read, and replaced on the next Put.
+//
 // It is strongly based on the acme/autocert DirCache type.
 // https://github.com/golang/crypto/blob/88942b9c40a4c9d203b82b3731787b672d6e809b/acme/autocert/cache.go#L40
 type DirCache string
 
 // Get reads a certificate data from the specified file name.
+// Bundles that can't be decoded, or where the private key doesn't
+// match the certificate, are reported as a wrapped ErrCacheMiss.
 func (d DirCache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
 	name = filepath.Join(string(d), name)
 
 	var (
-		cert tls.Certificate
+		cert *tls.Certificate
 		err  error
 		done = make(chan struct{})
 	)
 
 	go func() {
-		cert, err = tls.LoadX509KeyPair(name+certExt, name+keyExt)
+		defer close(done)
+
+		var data []byte
+		data, err = ioutil.ReadFile(name + bundleExt)
 		if err == nil {
-			// Need to parse the Leaf manually for expiration checks
-			var leaf *x509.Certificate
-			leaf, err = x509.ParseCertificate(cert.Certificate[0])
-			if err == nil {
-				cert.Leaf = leaf
+			cert, err = DecodeBundle(data)
+			if err != nil {
+				err = fmt.Errorf("%w: invalid certificate bundle %s: %v", ErrCacheMiss, name+bundleExt, err)
 			}
+			return
+		}
+		if os.IsNotExist(err) {
+			cert, err = loadKeyPair(name)
 		}
-		close(done)
 	}()
 
 	select {
@@ -123,6 +168,21 @@ func (d DirCache) Get(ctx context.Context, name string) (*tls.Certificate, error
 		return nil, err
 	}
 
+	return cert, nil
+}
+
+// loadKeyPair loads a certificate stored in separate
+// key and certificate files by earlier versions of DirCache.
+func loadKeyPair(name string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(name+certExt, name+keyExt)
+	if err != nil {
+		return nil, err
+	}
+	// Need to parse the Leaf manually for expiration checks
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
 	return &cert, nil
 }
 
@@ -133,34 +193,15 @@ func (d DirCache) Put(ctx context.Context, name string, cert *tls.Certificate) e
 		return err
 	}
 
+	data, err := EncodeBundle(cert)
+	if err != nil {
+		return err
+	}
+
 	done := make(chan struct{})
-	var (
-		err             error
-		tmpKey, tmpCert string
-		newName         = filepath.Join(string(d), name)
-	)
 	go func() {
 		defer close(done)
-
-		var tmpKey, tmpCert string
-		if tmpKey, tmpCert, err = d.writeTempFiles(name, cert); err != nil {
-			return
-		}
-
-		select {
-		case <-ctx.Done():
-			// Don't overwrite the file if the context was canceled.
-		default:
-			newName := filepath.Join(string(d), name)
-			err = os.Rename(tmpKey, newName+keyExt)
-			if err != nil {
-				return
-			}
-			err = os.Rename(tmpCert, newName+certExt)
-			if err != nil {
-				return
-			}
-		}
+		err = d.writeBundle(ctx, name, data)
 	}()
 
 	select {
@@ -169,17 +210,76 @@ func (d DirCache) Put(ctx context.Context, name string, cert *tls.Certificate) e
 	case <-done:
 	}
 
-	// Clean up after ourselves on error, remove all artifacts from this request
+	return err
+}
+
+// writeBundle atomically replaces the bundle file of name.
+func (d DirCache) writeBundle(ctx context.Context, name string, data []byte) (err error) {
+	// TempFile uses 0600 permissions, and replaces the last "*" of the
+	// pattern, so the "*" of wildcard names must not be the last.
+	f, err := ioutil.TempFile(string(d), tmpPrefix+strings.ReplaceAll(name, "*", "_")+bundleExt+".*")
 	if err != nil {
-		err = removeWrapErr(tmpKey, err)
-		err = removeWrapErr(tmpCert, err)
-		err = removeWrapErr(newName+keyExt, err)
-		err = removeWrapErr(newName+certExt, err)
+		return err
 	}
+	tmpName := f.Name()
+	defer func() {
+		// Clean up after ourselves on error
+		if err != nil {
+			err = removeWrapErr(tmpName, err)
+		}
+	}()
 
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	// Make sure the data is on disk before the
+	// rename makes the file visible.
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		// Don't overwrite the file if the context was canceled.
+		return err
+	}
+
+	newName := filepath.Join(string(d), name)
+	if err = os.Rename(tmpName, newName+bundleExt); err != nil {
+		return err
+	}
+	if err = syncDir(string(d)); err != nil {
+		return err
+	}
+
+	// Remove any files written by earlier versions of DirCache
+	err = removeWrapErr(newName+keyExt, nil)
+	err = removeWrapErr(newName+certExt, err)
 	return err
 }
 
+// syncDir syncs the directory, to make
+// sure renames into it are persisted.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories can't be synced on Windows
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // Delete removes the specified file name.
 func (d DirCache) Delete(ctx context.Context, name string) error {
 	name = filepath.Join(string(d), name)
@@ -190,6 +290,7 @@ func (d DirCache) Delete(ctx context.Context, name string) error {
 	go func() {
 		defer close(done)
 
+		err = removeWrapErr(name+bundleExt, err)
 		err = removeWrapErr(name+keyExt, err)
 		err = removeWrapErr(name+certExt, err)
 	}()
@@ -202,67 +303,51 @@ func (d DirCache) Delete(ctx context.Context, name string) error {
 	return err
 }
 
-func removeWrapErr(fileName string, err error) error {
-	if e := os.Remove(fileName); e != nil && !os.IsNotExist(e) {
-		err = fmt.Errorf("failed to delete %s: %v: %v", fileName, e, err)
-	}
-
-	return err
-}
-
-// writeTempFile writes b to a temporary file, closes the file and returns its path.
-func (d DirCache) writeTempFiles(prefix string, cert *tls.Certificate) (string, string, error) {
-	keyPath, err := d.writeTempKey(prefix, cert)
-	if err != nil {
-		return "", "", err
-	}
-
-	certPath, err := d.writeTempCert(prefix, cert)
+// List lists the certificates in the directory.
+func (d DirCache) List(ctx context.Context) ([]CacheEntry, error) {
+	infos, err := ioutil.ReadDir(string(d))
 	if err != nil {
-		return "", "", err
-	}
-
-	return keyPath, certPath, err
-}
-
-func (d DirCache) writeTempKey(prefix string, cert *tls.Certificate) (string, error) {
-	pem, err := keys.Marshal(cert.PrivateKey)
-	if err != nil {
-		return "", err
-	}
-
-	// TempFile uses 0600 permissions
-	f, err := ioutil.TempFile(string(d), prefix+keyExt)
-	if err != nil {
-		return "", err
+		if os.IsNotExist(err) {
+			return []CacheEntry{}, nil
+		}
+		return nil, err
 	}
 
-	if _, err = f.Write(pem); err != nil {
-		return "", err
+	entries := []CacheEntry{}
+	listed := map[string]bool{}
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != bundleExt && ext != certExt) {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), ext)
+		if listed[name] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Get prefers the bundle over files written by earlier versions
+		cert, err := d.Get(ctx, name)
+		if err != nil {
+			continue
+		}
+		if entry, ok := newCacheEntry(name, cert); ok {
+			entries = append(entries, entry)
+			listed[name] = true
+		}
 	}
+	sortEntries(entries)
 
-	return f.Name(), f.Close()
+	return entries, nil
 }
 
-func (d DirCache) writeTempCert(prefix string, cert *tls.Certificate) (string, error) {
-	f, err := ioutil.TempFile(string(d), prefix+certExt)
-	if err != nil {
-		return "", err
-	}
-
-	for _, c := range cert.Certificate {
-		block := &pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: c,
-		}
-
-		err := pem.Encode(f, block)
-		if err != nil {
-			return "", err
-		}
+func removeWrapErr(fileName string, err error) error {
+	if e := os.Remove(fileName); e != nil && !os.IsNotExist(e) {
+		err = fmt.Errorf("failed to delete %s: %v: %v", fileName, e, err)
 	}
 
-	return f.Name(), f.Close()
+	return err
 }
 
 type noopCache struct{}
@@ -0,0 +1,282 @@
+// Package kubernetes implements a certify.Cache backed by Kubernetes
+// Secrets of type kubernetes.io/tls, making certificates issued by
+// certify visible to other consumers in the cluster, such as
+// ingress controllers, and a certify.Locker backed by Leases.
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/internal/keys"
+)
+
+const (
+	defaultNamePrefix = "certify-"
+
+	// NameAnnotation is the annotation holding the name
+	// a Secret is stored under in the Cache.
+	NameAnnotation = "certify.johanbrandhorst.com/name"
+	// ManagedByLabel is the label identifying Secrets
+	// managed by the Cache, set to "certify".
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+
+	managedBy = "certify"
+
+	// Key of the CA certificate in kubernetes.io/tls Secrets
+	caCertKey = "ca.crt"
+
+	// Maximum length of a Secret name
+	maxNameLength = 253
+)
+
+// Cache implements the certify.Cache interface with Kubernetes
+// Secrets of type kubernetes.io/tls. The certificate chain is
+// stored in "tls.crt", the private key in "tls.key" and, if the
+// chain includes more than the leaf certificate, the last
+// certificate of the chain in "ca.crt".
+//
+// Names are converted to valid Secret names by lowercasing them,
+// replacing "*" with "wildcard" and other invalid characters with
+// "-", removing "-" from the start and end of each label and, if
+// the name changed, appending a hash of the name. The name is stored in the
+// NameAnnotation annotation of the Secret.
+//
+// As the private key must be usable by other consumers of the Secret,
+// the Cache can't be wrapped in a certify.EncryptedCache.
+//
+// The Cache only reads, modifies and deletes Secrets it created,
+// and returns an error if another Secret has the name of a
+// certificate. It needs permission to get, create, update and
+// delete Secrets in the namespace.
+//
+// Client and Namespace are required.
+type Cache struct {
+	// Client is a Kubernetes client. It can be created
+	// via, for example:
+	//    conf, err := rest.InClusterConfig()
+	//    // handle error
+	//    cli, err := kubernetes.NewForConfig(conf)
+	Client kubernetes.Interface
+	// Namespace is the namespace Secrets are stored in.
+	Namespace string
+
+	// NamePrefix is prepended to the names of certificates
+	// to form the names of their Secrets.
+	// Defaults to "certify-".
+	NamePrefix string
+	// Labels are added to the Secrets created.
+	Labels map[string]string
+}
+
+// Get gets the certificate stored under the name.
+func (c *Cache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	secret, err := c.Client.CoreV1().Secrets(c.Namespace).Get(ctx, c.secretName(name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, certify.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Someone else's Secret, or a name colliding with this one.
+	// It's not reported as a miss, as the certificate issued
+	// for it couldn't be stored, and would be issued again
+	// on every request.
+	if err := checkManaged(secret, name); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate in Secret %s: %v", certify.ErrCacheMiss, secret.Name, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate in Secret %s: %v", certify.ErrCacheMiss, secret.Name, err)
+	}
+
+	return &cert, nil
+}
+
+// Put stores the certificate under the name, creating
+// a Secret, or updating the existing Secret.
+func (c *Cache) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	data, err := secretData(cert)
+	if err != nil {
+		return err
+	}
+
+	secrets := c.Client.CoreV1().Secrets(c.Namespace)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.secretName(name),
+			Namespace: c.Namespace,
+			Labels:    map[string]string{},
+			Annotations: map[string]string{
+				NameAnnotation: name,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: data,
+	}
+	for k, v := range c.Labels {
+		secret.Labels[k] = v
+	}
+	secret.Labels[ManagedByLabel] = managedBy
+
+	_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := checkManaged(existing, name); err != nil {
+			return err
+		}
+		existing.Data = data
+		for k, v := range secret.Labels {
+			if existing.Labels == nil {
+				existing.Labels = map[string]string{}
+			}
+			existing.Labels[k] = v
+		}
+		_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Delete deletes the Secret of the certificate stored under the name.
+func (c *Cache) Delete(ctx context.Context, name string) error {
+	secrets := c.Client.CoreV1().Secrets(c.Namespace)
+	secret, err := secrets.Get(ctx, c.secretName(name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkManaged(secret, name); err != nil {
+		return err
+	}
+
+	// Make sure the Secret hasn't been replaced since it was checked
+	err = secrets.Delete(ctx, secret.Name, metav1.DeleteOptions{
+		Preconditions: metav1.NewUIDPreconditions(string(secret.UID)),
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// secretName returns the name of the Secret the
+// certificate with the name is stored in.
+func (c *Cache) secretName(name string) string {
+	return objectName(c.NamePrefix, name)
+}
+
+// objectName returns a valid object name for the name,
+// see the Cache documentation for details.
+func objectName(prefix, name string) string {
+	if prefix == "" {
+		prefix = defaultNamePrefix
+	}
+	objName := sanitize(prefix + name)
+	if objName == prefix+name {
+		return objName
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if len(objName)+len(suffix) > maxNameLength {
+		objName = strings.TrimRight(objName[:maxNameLength-len(suffix)], "-.")
+	}
+	return objName + suffix
+}
+
+// sanitize converts the name to a valid Secret name, which must
+// be a lowercase RFC 1123 subdomain: labels of alphanumerics and
+// "-", starting and ending with an alphanumeric, separated by ".".
+func sanitize(name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), "*", "wildcard")
+	b := []byte(name)
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '.' {
+			b[i] = '-'
+		}
+	}
+
+	labels := strings.Split(string(b), ".")
+	valid := labels[:0]
+	for _, label := range labels {
+		if label = strings.Trim(label, "-"); label != "" {
+			valid = append(valid, label)
+		}
+	}
+	name = strings.Join(valid, ".")
+	if len(name) > maxNameLength {
+		name = strings.TrimRight(name[:maxNameLength], "-.")
+	}
+	return name
+}
+
+// checkManaged returns an error if the Secret
+// isn't managed by the Cache under the name.
+func checkManaged(secret *corev1.Secret, name string) error {
+	if secret.Labels[ManagedByLabel] != managedBy || secret.Annotations[NameAnnotation] != name {
+		return fmt.Errorf("secret %s/%s exists and is not managed by certify for %s", secret.Namespace, secret.Name, name)
+	}
+	return nil
+}
+
+// secretData returns the data of a kubernetes.io/tls Secret for the certificate.
+func secretData(cert *tls.Certificate) (map[string][]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate has no chain")
+	}
+	if _, ok := cert.PrivateKey.(*certify.SealedKey); ok {
+		return nil, errors.New("private keys sealed by certify.EncryptedCache can't be stored in kubernetes.io/tls Secrets")
+	}
+	keyPEM, err := keys.Marshal(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var certPEM bytes.Buffer
+	for _, c := range cert.Certificate {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: c}); err != nil {
+			return nil, err
+		}
+	}
+
+	data := map[string][]byte{
+		corev1.TLSCertKey:       certPEM.Bytes(),
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}
+	if len(cert.Certificate) > 1 {
+		data[caCertKey] = pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Certificate[len(cert.Certificate)-1],
+		})
+	}
+	return data, nil
+}
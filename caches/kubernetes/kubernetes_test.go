@@ -0,0 +1,330 @@
+package kubernetes_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/caches/kubernetes"
+	"github.com/johanbrandhorst/certify/internal/testcert"
+)
+
+var _ certify.Cache = (*kubernetes.Cache)(nil)
+
+const namespace = "certify"
+
+func newCache() (*kubernetes.Cache, *fake.Clientset) {
+	cli := fake.NewSimpleClientset()
+	return &kubernetes.Cache{
+		Client:    cli,
+		Namespace: namespace,
+	}, cli
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("It stores certificates in TLS Secrets", func(t *testing.T) {
+		t.Parallel()
+		cache, cli := newCache()
+		cache.Labels = map[string]string{"app": "myapp"}
+		ca := testcert.GenerateCA(t, time.Now().Add(time.Hour))
+		cert := testcert.GenerateSigned(t, time.Now().Add(time.Hour), ca)
+
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+
+		secret, err := cli.CoreV1().Secrets(namespace).Get(ctx, "certify-myserver.com", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret.Type != corev1.SecretTypeTLS {
+			t.Fatalf("Unexpected Secret type %q", secret.Type)
+		}
+		if secret.Labels["app"] != "myapp" || secret.Labels[kubernetes.ManagedByLabel] != "certify" {
+			t.Fatalf("Unexpected Secret labels %v", secret.Labels)
+		}
+		if strings.Count(string(secret.Data[corev1.TLSCertKey]), "BEGIN CERTIFICATE") != 2 {
+			t.Fatal("Expected certificate chain to be stored in tls.crt")
+		}
+		block, _ := pem.Decode(secret.Data["ca.crt"])
+		if block == nil || !bytes.Equal(block.Bytes, ca.Certificate[0]) {
+			t.Fatal("Expected CA certificate to be stored in ca.crt")
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) || len(cached.Certificate) != 2 {
+			t.Fatal("Unexpected certificate returned from cache")
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+	})
+
+	t.Run("It updates existing Secrets", func(t *testing.T) {
+		t.Parallel()
+		cache, _ := newCache()
+		ca := testcert.GenerateCA(t, time.Now().Add(time.Hour))
+
+		if err := cache.Put(ctx, "myserver.com", testcert.GenerateSigned(t, time.Now().Add(time.Hour), ca)); err != nil {
+			t.Fatal(err)
+		}
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) || len(cached.Certificate) != 1 {
+			t.Fatal("Expected certificate to be updated")
+		}
+	})
+
+	t.Run("It deletes Secrets", func(t *testing.T) {
+		t.Parallel()
+		cache, cli := newCache()
+
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+		secrets, err := cli.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secrets.Items) != 0 {
+			t.Fatalf("Expected Secret to be deleted, got %d Secrets", len(secrets.Items))
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatalf("Expected no error deleting missing certificate, got %v", err)
+		}
+	})
+
+	t.Run("It converts names to valid Secret names", func(t *testing.T) {
+		t.Parallel()
+		cache, cli := newCache()
+
+		names := []string{"*.MyServer.com", "_.myserver.com", "-a-..b_.myserver.com", "myserver.com+batch+ecdsa"}
+		for _, name := range names {
+			if err := cache.Put(ctx, name, testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+				t.Fatalf("Failed to put %q: %v", name, err)
+			}
+		}
+		secrets, err := cli.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secrets.Items) != len(names) {
+			t.Fatalf("Expected a Secret per name, got %d Secrets", len(secrets.Items))
+		}
+		for _, s := range secrets.Items {
+			if errs := validation.IsDNS1123Subdomain(s.Name); len(errs) != 0 {
+				t.Fatalf("Invalid Secret name %q: %v", s.Name, errs)
+			}
+		}
+		for _, name := range names {
+			if _, err := cache.Get(ctx, name); err != nil {
+				t.Fatalf("Failed to get %q: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("It leaves other Secrets alone", func(t *testing.T) {
+		t.Parallel()
+		cache, cli := newCache()
+		other := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "certify-myserver.com",
+				Namespace: namespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+		}
+		if _, err := cli.CoreV1().Secrets(namespace).Create(ctx, other, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cache.Get(ctx, "myserver.com"); err == nil || errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected error reading unmanaged Secret, got %v", err)
+		}
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err == nil {
+			t.Fatal("Expected error overwriting unmanaged Secret")
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err == nil {
+			t.Fatal("Expected error deleting unmanaged Secret")
+		}
+	})
+
+	t.Run("It reports invalid Secrets as cache misses", func(t *testing.T) {
+		t.Parallel()
+		cache, cli := newCache()
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := cli.CoreV1().Secrets(namespace).Get(ctx, "certify-myserver.com", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret.Data[corev1.TLSPrivateKeyKey] = testcert.Generate(t, time.Now().Add(time.Hour)).Certificate[0]
+		if _, err := cli.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cache.Get(ctx, "myserver.com")
+		if !errors.Is(err, certify.ErrCacheMiss) || err == certify.ErrCacheMiss {
+			t.Fatalf("Expected wrapped ErrCacheMiss, got %v", err)
+		}
+	})
+
+	t.Run("It rejects private keys sealed by an EncryptedCache", func(t *testing.T) {
+		t.Parallel()
+		cache, _ := newCache()
+		keys, err := certify.NewKeyring(make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := &certify.EncryptedCache{Cache: cache, Keys: keys}
+		err = encrypted.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour)))
+		if err == nil || !strings.Contains(err.Error(), "EncryptedCache") {
+			t.Fatalf("Expected error storing sealed private key, got %v", err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); !errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+	})
+}
+
+var _ certify.Locker = (*kubernetes.Locker)(nil)
+
+func TestLocker(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	newLocker := func() *kubernetes.Locker {
+		return &kubernetes.Locker{
+			Client:    fake.NewSimpleClientset(),
+			Namespace: namespace,
+			Identity:  "mypod",
+		}
+	}
+
+	t.Run("It blocks until the Lease is released", func(t *testing.T) {
+		t.Parallel()
+		locker := newLocker()
+
+		unlock, err := locker.Lock(ctx, "*.myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases, err := locker.Client.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leases.Items) != 1 || !strings.HasPrefix(*leases.Items[0].Spec.HolderIdentity, "mypod-") {
+			t.Fatalf("Unexpected Leases %v", leases.Items)
+		}
+		if errs := validation.IsDNS1123Subdomain(leases.Items[0].Name); len(errs) != 0 {
+			t.Fatalf("Invalid Lease name %q: %v", leases.Items[0].Name, errs)
+		}
+
+		acquired := make(chan error)
+		go func() {
+			unlock, err := locker.Lock(ctx, "*.myserver.com")
+			if err == nil {
+				err = unlock()
+			}
+			acquired <- err
+		}()
+		select {
+		case err := <-acquired:
+			t.Fatalf("Lease acquired while held: %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lease not acquired after release")
+		}
+	})
+
+	t.Run("It returns when the context is done", func(t *testing.T) {
+		t.Parallel()
+		locker := newLocker()
+		if _, err := locker.Lock(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if _, err := locker.Lock(ctx, "myserver.com"); err != context.DeadlineExceeded {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("It takes over expired Leases", func(t *testing.T) {
+		t.Parallel()
+		locker := newLocker()
+		unlock, err := locker.Lock(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leases := locker.Client.CoordinationV1().Leases(namespace)
+		lease, err := leases.Get(ctx, "certify-myserver.com", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+		lease.Spec.RenewTime = &expired
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		newUnlock, err := locker.Lock(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leases.Get(ctx, "certify-myserver.com", metav1.GetOptions{}); err != nil {
+			t.Fatalf("Expected Lease taken over after expiry to be kept, got %v", err)
+		}
+		if err := newUnlock(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leases.Get(ctx, "certify-myserver.com", metav1.GetOptions{}); err == nil {
+			t.Fatal("Expected Lease to be deleted")
+		}
+	})
+}
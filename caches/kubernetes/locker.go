@@ -0,0 +1,184 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultLockTTL = 5 * time.Minute
+	lockRetryWait  = 250 * time.Millisecond
+	unlockTimeout  = 10 * time.Second
+)
+
+// Locker implements the certify.Locker interface with Kubernetes
+// Leases, so only one of several instances sharing a Cache issues
+// a certificate for a name at a time. Leases are named like the
+// Secrets of Cache, and are deleted when released. Leases not
+// released within TTL are taken over by other instances.
+//
+// Locker needs permission to get, create, update and
+// delete Leases in the namespace.
+//
+// Client and Namespace are required.
+type Locker struct {
+	// Client is a Kubernetes client.
+	Client kubernetes.Interface
+	// Namespace is the namespace Leases are created in.
+	Namespace string
+
+	// NamePrefix is prepended to the names of certificates
+	// to form the names of their Leases.
+	// Defaults to "certify-".
+	NamePrefix string
+	// Identity identifies the instance in the holderIdentity of
+	// the Leases it holds, followed by a random suffix.
+	// Defaults to the hostname, which is the Pod name.
+	Identity string
+
+	// TTL is how long a lock can be held before it expires.
+	// It should be longer than the Certify IssueTimeout.
+	// Defaults to 5 minutes.
+	TTL time.Duration
+}
+
+// Lock acquires the Lease for the name,
+// waiting for it to be released or expire.
+func (l *Locker) Lock(ctx context.Context, name string) (func() error, error) {
+	ttl := l.TTL
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	holder, err := l.holderIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := l.Client.CoordinationV1().Leases(l.Namespace)
+	leaseName := objectName(l.NamePrefix, name)
+	for {
+		acquired, err := l.tryLock(ctx, leaseName, holder, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return func() error {
+				// The context of the request may be done by now
+				ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+				defer cancel()
+
+				lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+					// Expired and taken over
+					return nil
+				}
+				err = leases.Delete(ctx, leaseName, metav1.DeleteOptions{
+					Preconditions: &metav1.Preconditions{
+						UID:             &lease.UID,
+						ResourceVersion: &lease.ResourceVersion,
+					},
+				})
+				if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+					return nil
+				}
+				return err
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryWait):
+		}
+	}
+}
+
+// tryLock creates the Lease, or takes it over if it has
+// expired, and reports whether the Lease was acquired.
+func (l *Locker) tryLock(ctx context.Context, leaseName, holder string, ttl time.Duration) (bool, error) {
+	leases := l.Client.CoordinationV1().Leases(l.Namespace)
+	now := metav1.NowMicro()
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	spec := coordinationv1.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &seconds,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+
+	lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaseName,
+				Namespace: l.Namespace,
+				Labels: map[string]string{
+					ManagedByLabel: managedBy,
+				},
+			},
+			Spec: spec,
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !leaseExpired(lease, now.Time) {
+		return false, nil
+	}
+	lease.Spec = spec
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		// Taken over by another instance first
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// holderIdentity returns a unique identity for a holder of a Lease.
+func (l *Locker) holderIdentity() (string, error) {
+	identity := l.Identity
+	if identity == "" {
+		var err error
+		identity, err = os.Hostname()
+		if err != nil {
+			return "", err
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return identity + "-" + hex.EncodeToString(b), nil
+}
+
+// leaseExpired reports whether the Lease is free to be taken over.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" {
+		return true
+	}
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
@@ -0,0 +1,86 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultLockKeyPrefix = "certify:lock:"
+	defaultLockTTL       = 5 * time.Minute
+	lockRetryWait        = 250 * time.Millisecond
+	unlockTimeout        = 10 * time.Second
+)
+
+// unlockScript deletes the lock, if it's still held with the token.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Locker implements the certify.Locker interface with Redis,
+// so only one of several instances sharing a Cache issues a
+// certificate for a name at a time. Locks are keys set with
+// a random token, expiring after TTL.
+//
+// Client is required.
+type Locker struct {
+	// Client is a pre-created Redis client.
+	Client redis.UniversalClient
+
+	// KeyPrefix is prepended to the names of certificates
+	// to form the Redis keys of their locks.
+	// Defaults to "certify:lock:".
+	KeyPrefix string
+
+	// TTL is how long a lock can be held before it expires.
+	// It should be longer than the Certify IssueTimeout.
+	// Defaults to 5 minutes.
+	TTL time.Duration
+}
+
+// Lock acquires the lock for the name,
+// waiting for it to be released or expire.
+func (l *Locker) Lock(ctx context.Context, name string) (func() error, error) {
+	prefix := l.KeyPrefix
+	if prefix == "" {
+		prefix = defaultLockKeyPrefix
+	}
+	ttl := l.TTL
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	key := prefix + name
+	for {
+		ok, err := l.Client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() error {
+				// The context of the request may be done by now
+				ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+				defer cancel()
+				return unlockScript.Run(ctx, l.Client, []string{key}, token).Err()
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryWait):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package redis implements a certify.Cache and a certify.Locker
+// backed by Redis, allowing several instances of a service to
+// share certificates.
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+const defaultKeyPrefix = "certify:cert:"
+
+// Cache implements the certify.Cache interface with Redis.
+// Certificates are stored in the format of certify.EncodeBundle,
+// with a TTL that expires them with the certificate.
+//
+// Client is required.
+type Cache struct {
+	// Client is a pre-created Redis client. It can be created
+	// via, for example:
+	//    cli := redis.NewClient(&redis.Options{
+	//        Addr: "localhost:6379",
+	//    })
+	Client redis.UniversalClient
+
+	// KeyPrefix is prepended to the names of certificates
+	// to form their Redis keys. Defaults to "certify:cert:",
+	// which doesn't overlap the keys of Locker.
+	//
+	// Earlier versions defaulted to "certify:". Set it to keep
+	// using certificates cached by them, rather than have the
+	// certificates issued again.
+	KeyPrefix string
+
+	// Keys configures encryption of private keys before they
+	// are stored in Redis. See certify.EncryptedCache for details.
+	// Defaults to no encryption.
+	Keys certify.KeyProvider
+}
+
+// Get gets the certificate stored under the name.
+func (c *Cache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	return c.cache().Get(ctx, name)
+}
+
+// Put stores the certificate under the name,
+// expiring it when the certificate expires.
+func (c *Cache) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	return c.cache().Put(ctx, name, cert)
+}
+
+// Delete deletes the certificate stored under the name.
+func (c *Cache) Delete(ctx context.Context, name string) error {
+	return c.cache().Delete(ctx, name)
+}
+
+func (c *Cache) cache() certify.Cache {
+	var s certify.Cache = &store{c}
+	if c.Keys != nil {
+		s = &certify.EncryptedCache{
+			Cache: s,
+			Keys:  c.Keys,
+		}
+	}
+	return s
+}
+
+func (c *Cache) key(name string) string {
+	prefix := c.KeyPrefix
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+	return prefix + name
+}
+
+// store stores certificates in Redis.
+type store struct {
+	*Cache
+}
+
+func (s *store) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := s.Client.Get(ctx, s.key(name)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, certify.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := certify.DecodeBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate bundle %s: %v", certify.ErrCacheMiss, name, err)
+	}
+
+	return cert, nil
+}
+
+func (s *store) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("certificate has no chain")
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	ttl := time.Until(leaf.NotAfter)
+	if ttl <= 0 {
+		// Already expired, make sure no stale
+		// certificate is left behind either.
+		return s.Delete(ctx, name)
+	}
+
+	data, err := certify.EncodeBundle(cert)
+	if err != nil {
+		return err
+	}
+
+	return s.Client.Set(ctx, s.key(name), data, ttl).Err()
+}
+
+func (s *store) Delete(ctx context.Context, name string) error {
+	return s.Client.Del(ctx, s.key(name)).Err()
+}
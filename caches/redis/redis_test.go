@@ -0,0 +1,230 @@
+package redis_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/caches/redis"
+	"github.com/johanbrandhorst/certify/internal/testcert"
+)
+
+var _ certify.Cache = (*redis.Cache)(nil)
+
+func newCache(t *testing.T) (*redis.Cache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cli := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { cli.Close() })
+	return &redis.Cache{Client: cli}, mr
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("It stores certificates until they expire", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		ttl := mr.TTL("certify:cert:myserver.com")
+		if ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Fatalf("Unexpected TTL %s, wanted close to 1h", ttl)
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Unexpected certificate returned from cache")
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+
+		mr.FastForward(time.Hour)
+		_, err = cache.Get(ctx, "myserver.com")
+		if !errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected ErrCacheMiss after expiry, got %v", err)
+		}
+	})
+
+	t.Run("It shares certificates between instances", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		other := &redis.Cache{Client: goredis.NewClient(&goredis.Options{Addr: mr.Addr()})}
+		defer other.Client.Close()
+
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Get(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss after delete, got %v", err)
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatalf("Expected no error deleting missing key, got %v", err)
+		}
+	})
+
+	t.Run("It doesn't store expired certificates", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		cache.KeyPrefix = "test/"
+
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(-time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+		if mr.Exists("test/myserver.com") {
+			t.Fatal("Expected expired certificate to not be stored")
+		}
+	})
+
+	t.Run("It reports invalid entries as cache misses", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		if err := mr.Set("certify:cert:myserver.com", "not a bundle"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := cache.Get(ctx, "myserver.com")
+		if !errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+	})
+
+	t.Run("It encrypts private keys", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		cache.Keys, _ = certify.NewKeyring(key)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := mr.Get("certify:cert:myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(stored, "EC PRIVATE KEY") || !strings.Contains(stored, "CERTIFY SEALED PRIVATE KEY") {
+			t.Fatalf("Expected private key to be encrypted, got:\n%s", stored)
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+	})
+}
+
+var _ certify.Locker = (*redis.Locker)(nil)
+
+func TestLocker(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("It blocks until the lock is released", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		locker := &redis.Locker{Client: cache.Client}
+
+		unlock, err := locker.Lock(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := mr.TTL("certify:lock:myserver.com"); ttl != 5*time.Minute {
+			t.Fatalf("Unexpected lock TTL %s", ttl)
+		}
+
+		acquired := make(chan error)
+		go func() {
+			unlock, err := locker.Lock(ctx, "myserver.com")
+			if err == nil {
+				err = unlock()
+			}
+			acquired <- err
+		}()
+		select {
+		case err := <-acquired:
+			t.Fatalf("Lock acquired while held: %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock not acquired after release")
+		}
+	})
+
+	t.Run("It returns when the context is done", func(t *testing.T) {
+		t.Parallel()
+		cache, _ := newCache(t)
+		locker := &redis.Locker{Client: cache.Client}
+		if _, err := locker.Lock(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if _, err := locker.Lock(ctx, "myserver.com"); err != context.DeadlineExceeded {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("It doesn't release locks taken over after expiry", func(t *testing.T) {
+		t.Parallel()
+		cache, mr := newCache(t)
+		locker := &redis.Locker{Client: cache.Client, TTL: time.Minute}
+
+		unlock, err := locker.Lock(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.FastForward(2 * time.Minute)
+		if _, err := locker.Lock(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if !mr.Exists("certify:lock:myserver.com") {
+			t.Fatal("Expected lock taken over after expiry to be kept")
+		}
+	})
+}
@@ -0,0 +1,327 @@
+// Package sql implements a certify.Cache backed by a SQL database,
+// allowing several instances of a service to share certificates,
+// and operators to query the certificates stored.
+package sql
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/internal/keys"
+)
+
+const defaultTable = "certify_certificates"
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Dialect is the SQL dialect of a database.
+type Dialect string
+
+// Supported SQL dialects.
+const (
+	// Postgres is the dialect of PostgreSQL databases.
+	Postgres Dialect = "postgres"
+	// MySQL is the dialect of MySQL and MariaDB databases.
+	// The connection must be configured with parseTime=true.
+	MySQL Dialect = "mysql"
+	// SQLite is the dialect of SQLite databases.
+	SQLite Dialect = "sqlite"
+)
+
+// Cache implements the certify.Cache interface with a SQL database.
+// Each certificate is stored in a row of Table, with the columns
+//
+//	name              the name the certificate is stored under
+//	certificate_chain the PEM encoded certificate chain
+//	private_key       the PEM encoded private key
+//	not_after         the expiry of the certificate, in UTC
+//	updated_at        the time the row was last written, in UTC
+//
+// so upcoming expiries can be queried with, for example:
+//
+//	SELECT name, not_after FROM certify_certificates ORDER BY not_after
+//
+// The table must be created with Migrate before the Cache is used.
+// As private keys are stored in PEM format, the Cache can't be
+// wrapped in a certify.EncryptedCache.
+//
+// DB and Dialect are required.
+type Cache struct {
+	// DB is the database to store certificates in. It is opened
+	// with the driver for the database, for example:
+	//    db, err := sql.Open("pgx", "postgres://localhost:5432/mydb")
+	DB *sql.DB
+	// Dialect is the SQL dialect of the database.
+	Dialect Dialect
+
+	// Table is the name of the table certificates are stored in.
+	// The table Table+"_migrations" is used to track migrations.
+	// Defaults to "certify_certificates".
+	Table string
+}
+
+// migration is a schema migration,
+// consisting of one or more statements.
+type migration []string
+
+// migrations are the schema migrations of each dialect,
+// in the order they are applied. Migrations must not be
+// modified once released, only appended to. Statements are
+// formatted with the name of the table as their only argument.
+var migrations = map[Dialect][]migration{
+	Postgres: {
+		{
+			`CREATE TABLE %[1]s (
+				name VARCHAR(255) NOT NULL PRIMARY KEY,
+				certificate_chain TEXT NOT NULL,
+				private_key TEXT NOT NULL,
+				not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+			)`,
+			`CREATE INDEX %[1]s_not_after ON %[1]s (not_after)`,
+		},
+	},
+	MySQL: {
+		{
+			`CREATE TABLE %[1]s (
+				name VARCHAR(255) NOT NULL PRIMARY KEY,
+				certificate_chain TEXT NOT NULL,
+				private_key TEXT NOT NULL,
+				not_after DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				INDEX %[1]s_not_after (not_after)
+			)`,
+		},
+	},
+	SQLite: {
+		{
+			`CREATE TABLE %[1]s (
+				name TEXT NOT NULL PRIMARY KEY,
+				certificate_chain TEXT NOT NULL,
+				private_key TEXT NOT NULL,
+				not_after TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX %[1]s_not_after ON %[1]s (not_after)`,
+		},
+	},
+}
+
+// Migrate creates or updates the schema of the table certificates
+// are stored in. It applies the migrations not yet applied to the
+// database, and must be called before the Cache is used, and after
+// upgrading certify. It is safe to call Migrate every time an
+// application starts, including from several instances at once.
+func (c *Cache) Migrate(ctx context.Context) error {
+	table, err := c.table()
+	if err != nil {
+		return err
+	}
+	ms, ok := migrations[c.Dialect]
+	if !ok {
+		return fmt.Errorf("unsupported SQL dialect %q", c.Dialect)
+	}
+
+	_, err = c.DB.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s_migrations (version INTEGER NOT NULL PRIMARY KEY)", table,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	version, err := c.version(ctx, table)
+	if err != nil {
+		return err
+	}
+	for version < len(ms) {
+		if err := c.migrate(ctx, table, version+1, ms[version]); err != nil {
+			// Another instance may have applied it concurrently
+			if v, vErr := c.version(ctx, table); vErr != nil || v <= version {
+				return fmt.Errorf("failed to apply migration %d: %w", version+1, err)
+			}
+		}
+		version, err = c.version(ctx, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// version returns the version of the last migration applied.
+func (c *Cache) version(ctx context.Context, table string) (int, error) {
+	var version int
+	err := c.DB.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT COALESCE(MAX(version), 0) FROM %s_migrations", table,
+	)).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies a migration, recording its version.
+// MySQL commits schema changes implicitly, so a
+// failed migration may need to be cleaned up manually.
+func (c *Cache) migrate(ctx context.Context, table string, version int, m migration) error {
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(stmt, table)); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s_migrations (version) VALUES (%s)", table, c.placeholder(1),
+	), version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get gets the certificate stored under the name.
+func (c *Cache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	table, err := c.table()
+	if err != nil {
+		return nil, err
+	}
+
+	var chainPEM, keyPEM string
+	err = c.DB.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT certificate_chain, private_key FROM %s WHERE name = %s", table, c.placeholder(1),
+	), name).Scan(&chainPEM, &keyPEM)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, certify.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair([]byte(chainPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate %s: %v", certify.ErrCacheMiss, name, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate %s: %v", certify.ErrCacheMiss, name, err)
+	}
+
+	return &cert, nil
+}
+
+// Put stores the certificate under the name,
+// replacing any certificate already stored.
+func (c *Cache) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	table, err := c.table()
+	if err != nil {
+		return err
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("certificate has no chain")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := cert.PrivateKey.(*certify.SealedKey); ok {
+		return errors.New("private keys sealed by certify.EncryptedCache can't be stored in a SQL Cache")
+	}
+	keyPEM, err := keys.Marshal(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var chainPEM bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return err
+		}
+	}
+
+	var upsert string
+	switch c.Dialect {
+	case MySQL:
+		upsert = `ON DUPLICATE KEY UPDATE
+			certificate_chain = VALUES(certificate_chain),
+			private_key = VALUES(private_key),
+			not_after = VALUES(not_after),
+			updated_at = VALUES(updated_at)`
+	case Postgres, SQLite:
+		upsert = `ON CONFLICT (name) DO UPDATE SET
+			certificate_chain = excluded.certificate_chain,
+			private_key = excluded.private_key,
+			not_after = excluded.not_after,
+			updated_at = excluded.updated_at`
+	default:
+		return fmt.Errorf("unsupported SQL dialect %q", c.Dialect)
+	}
+
+	_, err = c.DB.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (name, certificate_chain, private_key, not_after, updated_at) VALUES (%s) %s",
+		table, c.placeholders(5), upsert,
+	), name, chainPEM.String(), string(keyPEM), leaf.NotAfter.UTC(), time.Now().UTC())
+	return err
+}
+
+// Delete deletes the certificate stored under the name.
+func (c *Cache) Delete(ctx context.Context, name string) error {
+	table, err := c.table()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DB.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE name = %s", table, c.placeholder(1),
+	), name)
+	return err
+}
+
+// table returns the name of the table, after
+// checking that it's safe to use in statements.
+func (c *Cache) table() (string, error) {
+	if c.Table == "" {
+		return defaultTable, nil
+	}
+	if !validTable.MatchString(c.Table) {
+		return "", fmt.Errorf("invalid table name %q", c.Table)
+	}
+	return c.Table, nil
+}
+
+// placeholder returns the placeholder
+// for the nth argument of a statement.
+func (c *Cache) placeholder(n int) string {
+	if c.Dialect == Postgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// placeholders returns the comma separated
+// placeholders for n arguments of a statement.
+func (c *Cache) placeholders(n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = c.placeholder(i + 1)
+	}
+	return strings.Join(ps, ", ")
+}
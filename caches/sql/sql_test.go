@@ -0,0 +1,213 @@
+package sql_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/johanbrandhorst/certify"
+	certifysql "github.com/johanbrandhorst/certify/caches/sql"
+	"github.com/johanbrandhorst/certify/internal/testcert"
+)
+
+var _ certify.Cache = (*certifysql.Cache)(nil)
+
+func newCache(t *testing.T) *certifysql.Cache {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "certify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cache := &certifysql.Cache{
+		DB:      db,
+		Dialect: certifysql.SQLite,
+	}
+	if err := cache.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("It stores, replaces and deletes certificates", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Unexpected certificate returned from cache")
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+
+		cert = testcert.Generate(t, time.Now().Add(2*time.Hour))
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		cached, err = cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Expected certificate to be replaced")
+		}
+
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss after delete, got %v", err)
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatalf("Expected no error deleting missing certificate, got %v", err)
+		}
+	})
+
+	t.Run("It stores expiries that can be queried", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		soon := testcert.Generate(t, time.Now().Add(time.Hour))
+		later := testcert.Generate(t, time.Now().Add(24*time.Hour))
+		if err := cache.Put(ctx, "later.com", later); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Put(ctx, "soon.com", soon); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := cache.DB.QueryContext(ctx,
+			"SELECT name, not_after FROM certify_certificates WHERE not_after < ? ORDER BY not_after",
+			time.Now().Add(2*time.Hour).UTC(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			var notAfter time.Time
+			if err := rows.Scan(&name, &notAfter); err != nil {
+				t.Fatal(err)
+			}
+			if !notAfter.Equal(soon.Leaf.NotAfter) {
+				t.Fatalf("Unexpected expiry %s, wanted %s", notAfter, soon.Leaf.NotAfter)
+			}
+			names = append(names, name)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != "soon.com" {
+			t.Fatalf("Unexpected certificates expiring soon: %v", names)
+		}
+	})
+
+	t.Run("It migrates idempotently", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Migrate(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		var version int
+		err := cache.DB.QueryRowContext(ctx, "SELECT MAX(version) FROM certify_certificates_migrations").Scan(&version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 {
+			t.Fatalf("Unexpected schema version %d", version)
+		}
+	})
+
+	t.Run("It uses the configured table", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		cache.Table = "my_certificates"
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err == nil {
+			t.Fatal("Expected error before migrating")
+		}
+		if err := cache.Migrate(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+
+		cache.Table = "certificates; DROP TABLE my_certificates"
+		if err := cache.Migrate(ctx); err == nil {
+			t.Fatal("Expected error for invalid table name")
+		}
+	})
+
+	t.Run("It reports invalid entries as cache misses", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		_, err := cache.DB.ExecContext(ctx, "UPDATE certify_certificates SET private_key = 'not a key'")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cache.Get(ctx, "myserver.com")
+		if !errors.Is(err, certify.ErrCacheMiss) || err == certify.ErrCacheMiss {
+			t.Fatalf("Expected wrapped ErrCacheMiss, got %v", err)
+		}
+	})
+
+	t.Run("It rejects private keys sealed by an EncryptedCache", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		keys, err := certify.NewKeyring(make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := &certify.EncryptedCache{Cache: cache, Keys: keys}
+		err = encrypted.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour)))
+		if err == nil || !strings.Contains(err.Error(), "EncryptedCache") {
+			t.Fatalf("Expected error storing sealed private key, got %v", err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); !errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+	})
+
+	t.Run("It rejects unsupported dialects", func(t *testing.T) {
+		t.Parallel()
+		cache := newCache(t)
+		cache.Dialect = "oracle"
+		if err := cache.Migrate(ctx); err == nil {
+			t.Fatal("Expected error for unsupported dialect")
+		}
+	})
+}
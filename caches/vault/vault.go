@@ -0,0 +1,384 @@
+// Package vault implements a certify.Cache backed by a Hashicorp Vault
+// KV version 2 secrets engine, allowing several instances of a service
+// to share certificates without another datastore.
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/issuers/vault"
+)
+
+const (
+	defaultMount      = "secret"
+	defaultPathPrefix = "certify/"
+	defaultMaxRetries = 5
+)
+
+// Cache implements the certify.Cache interface with a Hashicorp Vault
+// KV version 2 secrets engine. Certificates are stored in the format of
+// certify.EncodeBundle, in the "bundle" field of a secret per name.
+//
+// Writes use check-and-set, so instances storing a certificate
+// under the same name concurrently don't overwrite each other
+// unknowingly. If another instance stored a certificate first,
+// and it's valid for at least as long and for all names of the
+// certificate being written, it's kept and the write is discarded,
+// so all instances converge on the same certificate.
+// Otherwise, the write is retried.
+//
+// The token used must be allowed to read, create and update
+// "<Mount>/data/<PathPrefix>*" and delete "<Mount>/metadata/<PathPrefix>*".
+//
+// URL and AuthMethod are required, unless created with FromClient.
+type Cache struct {
+	// URL is the URL of the Vault instance.
+	URL *url.URL
+	// AuthMethod configures the method used for authenticating
+	// against the Vault server. See the vault issuer package
+	// for implementations.
+	AuthMethod vault.AuthMethod
+	// TLSConfig allows configuration of the TLS config
+	// used when connecting to the Vault server.
+	TLSConfig *tls.Config
+
+	// Mount is the name under which the KV version 2
+	// secrets engine is mounted. Defaults to `secret`.
+	Mount string
+	// PathPrefix is prepended to the names of certificates
+	// to form the paths of their secrets. Defaults to `certify/`.
+	PathPrefix string
+
+	// MaxRetries configures how many times a write that
+	// conflicts with a concurrent write is retried.
+	// Defaults to 5.
+	MaxRetries int
+
+	// Keys configures encryption of private keys before they
+	// are stored in Vault. See certify.EncryptedCache for details.
+	// Defaults to no encryption beyond Vault's own.
+	Keys certify.KeyProvider
+
+	cliMu sync.Mutex
+	cli   *api.Client
+}
+
+// FromClient returns a Cache using the provided Vault API client.
+// Any changes to the caches properties must be done before using it.
+// The Cache will default to using the token already defined
+// in the client for authentication.
+func FromClient(v *api.Client) *Cache {
+	return &Cache{
+		AuthMethod: vault.ConstantToken(v.Token()),
+		cli:        v,
+	}
+}
+
+// Get gets the certificate stored under the name.
+func (c *Cache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	return c.cache().Get(ctx, name)
+}
+
+// Put stores the certificate under the name.
+func (c *Cache) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	return c.cache().Put(ctx, name, cert)
+}
+
+// Delete deletes all versions of the certificate stored under the name.
+func (c *Cache) Delete(ctx context.Context, name string) error {
+	return c.cache().Delete(ctx, name)
+}
+
+func (c *Cache) cache() certify.Cache {
+	var s certify.Cache = &store{c}
+	if c.Keys != nil {
+		s = &certify.EncryptedCache{
+			Cache: s,
+			Keys:  c.Keys,
+		}
+	}
+	return s
+}
+
+// client returns the Vault client, establishing a connection
+// if one doesn't already exist, with the token updated.
+func (c *Cache) client(ctx context.Context) (*api.Client, error) {
+	c.cliMu.Lock()
+	defer c.cliMu.Unlock()
+
+	if c.cli == nil { // Could be set by FromClient
+		vConf := api.DefaultConfig()
+		if c.TLSConfig != nil {
+			vConf.HttpClient.Transport.(*http.Transport).TLSClientConfig = c.TLSConfig.Clone()
+		}
+		vConf.Address = c.URL.String()
+		cli, err := api.NewClient(vConf)
+		if err != nil {
+			return nil, err
+		}
+		c.cli = cli
+	}
+
+	// Update token immediately before making the request
+	if err := c.AuthMethod.SetToken(ctx, c.cli); err != nil {
+		return nil, err
+	}
+
+	return c.cli, nil
+}
+
+func (c *Cache) path(endpoint, name string) string {
+	mount := c.Mount
+	if mount == "" {
+		mount = defaultMount
+	}
+	prefix := c.PathPrefix
+	if prefix == "" {
+		prefix = defaultPathPrefix
+	}
+	return "/v1/" + mount + "/" + endpoint + "/" + prefix + name
+}
+
+// store stores certificates in Vault.
+type store struct {
+	*Cache
+}
+
+// kvSecret is a version of a secret read from
+// the KV version 2 secrets engine.
+type kvSecret struct {
+	// Bundle is empty if the secret doesn't exist,
+	// or the version was deleted.
+	Bundle  string
+	Version int
+}
+
+func (s *store) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	secret, err := s.read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Bundle == "" {
+		return nil, certify.ErrCacheMiss
+	}
+
+	cert, err := certify.DecodeBundle([]byte(secret.Bundle))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate bundle %s: %v", certify.ErrCacheMiss, name, err)
+	}
+
+	return cert, nil
+}
+
+func (s *store) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("certificate has no chain")
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := certify.EncodeBundle(cert)
+	if err != nil {
+		return err
+	}
+
+	secret, err := s.read(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	maxRetries := s.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	for i := 0; ; i++ {
+		err = s.write(ctx, name, string(data), secret.Version)
+		if !isCASMismatch(err) {
+			return err
+		}
+
+		// Another instance wrote to the secret since it was read
+		secret, err = s.read(ctx, name)
+		if err != nil {
+			return err
+		}
+		if secret.Bundle != "" {
+			stored, err := certify.DecodeBundle([]byte(secret.Bundle))
+			if err == nil && !stored.Leaf.NotAfter.Before(leaf.NotAfter) && coversNames(stored.Leaf, leaf) {
+				// Keep the certificate already stored, it's as good as ours
+				return nil
+			}
+		}
+		if i == maxRetries {
+			return fmt.Errorf("failed to store certificate %s after %d conflicting writes", name, i+1)
+		}
+	}
+}
+
+func (s *store) Delete(ctx context.Context, name string) error {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cli.RawRequestWithContext(ctx, cli.NewRequest("DELETE", s.path("metadata", name)))
+	if resp != nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+	}
+	return err
+}
+
+// read reads the latest version of the secret stored under the name.
+func (s *store) read(ctx context.Context, name string) (kvSecret, error) {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return kvSecret{}, err
+	}
+
+	resp, err := cli.RawRequestWithContext(ctx, cli.NewRequest("GET", s.path("data", name)))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// The latest version may have been deleted, in which
+		// case the response still includes its metadata.
+		secret, parseErr := api.ParseSecret(resp.Body)
+		if parseErr != nil || secret == nil {
+			return kvSecret{}, nil
+		}
+		return parseKVSecret(secret)
+	}
+	if err != nil {
+		return kvSecret{}, err
+	}
+
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return kvSecret{}, err
+	}
+	if secret == nil {
+		return kvSecret{}, fmt.Errorf("no secret returned from Vault for %s", name)
+	}
+
+	return parseKVSecret(secret)
+}
+
+// write writes a new version of the secret stored under the name,
+// if the latest version is still the version given.
+func (s *store) write(ctx context.Context, name, bundle string, version int) error {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	r := cli.NewRequest("POST", s.path("data", name))
+	err = r.SetJSONBody(map[string]interface{}{
+		"options": map[string]interface{}{
+			"cas": version,
+		},
+		"data": map[string]interface{}{
+			"bundle": bundle,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := cli.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// https://www.vaultproject.io/api-docs/secret/kv/kv-v2#sample-response-1
+func parseKVSecret(secret *api.Secret) (kvSecret, error) {
+	var kv kvSecret
+	if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		switch v := metadata["version"].(type) {
+		case json.Number:
+			version, err := v.Int64()
+			if err != nil {
+				return kvSecret{}, fmt.Errorf("invalid secret version: %w", err)
+			}
+			kv.Version = int(version)
+		case float64:
+			kv.Version = int(v)
+		}
+	}
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		kv.Bundle, _ = data["bundle"].(string)
+	}
+	return kv, nil
+}
+
+// isCASMismatch reports whether the error was returned
+// because the check-and-set version didn't match.
+func isCASMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
+// coversNames reports whether the stored certificate is valid
+// for all the names the leaf certificate is valid for.
+func coversNames(stored, leaf *x509.Certificate) bool {
+	for _, name := range leaf.DNSNames {
+		if !containsString(stored.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range leaf.IPAddresses {
+		if !containsIP(stored.IPAddresses, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,342 @@
+package vault_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/caches/vault"
+	"github.com/johanbrandhorst/certify/internal/testcert"
+	issuer "github.com/johanbrandhorst/certify/issuers/vault"
+)
+
+var _ certify.Cache = (*vault.Cache)(nil)
+
+const testToken = "mytoken"
+
+// kvServer is a minimal in-memory implementation
+// of the Vault KV version 2 secrets engine API.
+type kvServer struct {
+	mu      sync.Mutex
+	secrets map[string][]map[string]interface{}
+	// beforeWrite, if set, is called before
+	// each write is checked and applied.
+	beforeWrite func(path string)
+}
+
+func (s *kvServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testToken {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		switch r.Method {
+		case http.MethodGet:
+			s.handleRead(w, path)
+		case http.MethodPost, http.MethodPut:
+			if s.beforeWrite != nil {
+				s.beforeWrite(path)
+			}
+			s.handleWrite(w, r, path)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/") && r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.secrets, strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *kvServer) handleRead(w http.ResponseWriter, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.secrets[path]
+	if len(versions) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"data": versions[len(versions)-1],
+			"metadata": map[string]interface{}{
+				"version": len(versions),
+			},
+		},
+	})
+}
+
+func (s *kvServer) handleWrite(w http.ResponseWriter, r *http.Request, path string) {
+	var body struct {
+		Options struct {
+			CAS *int `json:"cas"`
+		} `json:"options"`
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+		return
+	}
+	if err := s.put(path, body.Data, body.Options.CAS); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{}})
+}
+
+func (s *kvServer) put(path string, data map[string]interface{}, cas *int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cas != nil && *cas != len(s.secrets[path]) {
+		return errors.New("check-and-set parameter did not match the current version")
+	}
+	s.secrets[path] = append(s.secrets[path], data)
+	return nil
+}
+
+func (s *kvServer) putBundle(t *testing.T, path string, cert *tls.Certificate) {
+	t.Helper()
+	bundle, err := certify.EncodeBundle(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put(path, map[string]interface{}{"bundle": string(bundle)}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *kvServer) versions(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.secrets[path])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newCache(t *testing.T) (*vault.Cache, *kvServer) {
+	t.Helper()
+	kv := &kvServer{secrets: map[string][]map[string]interface{}{}}
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &vault.Cache{
+		URL:        u,
+		AuthMethod: issuer.ConstantToken(testToken),
+	}, kv
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("It stores and deletes certificates", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		if kv.versions("certify/myserver.com") != 1 {
+			t.Fatal("Expected certificate to be stored under the path prefix")
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Unexpected certificate returned from cache")
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+
+		// Overwrites use the latest version
+		if err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(2*time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		if kv.versions("certify/myserver.com") != 2 {
+			t.Fatal("Expected certificate to be overwritten")
+		}
+
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Get(ctx, "myserver.com"); err != certify.ErrCacheMiss {
+			t.Fatalf("Expected ErrCacheMiss after delete, got %v", err)
+		}
+		if err := cache.Delete(ctx, "myserver.com"); err != nil {
+			t.Fatalf("Expected no error deleting missing certificate, got %v", err)
+		}
+	})
+
+	t.Run("It keeps a concurrently stored certificate valid for longer", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+		other := testcert.Generate(t, time.Now().Add(2*time.Hour))
+		var once sync.Once
+		kv.beforeWrite = func(path string) {
+			once.Do(func() { kv.putBundle(t, path, other) })
+		}
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		if kv.versions("certify/myserver.com") != 1 {
+			t.Fatal("Expected conflicting write to be discarded")
+		}
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(other.Leaf) {
+			t.Fatal("Expected concurrently stored certificate to be kept")
+		}
+	})
+
+	t.Run("It overwrites a concurrently stored certificate expiring sooner", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(2*time.Hour))
+		var once sync.Once
+		kv.beforeWrite = func(path string) {
+			once.Do(func() { kv.putBundle(t, path, testcert.Generate(t, time.Now().Add(time.Hour))) })
+		}
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		if kv.versions("certify/myserver.com") != 2 {
+			t.Fatal("Expected write to be retried")
+		}
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Expected certificate to overwrite the concurrently stored certificate")
+		}
+	})
+
+	t.Run("It overwrites a concurrently stored certificate missing names", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour), "a.myserver.com", "b.myserver.com")
+		var once sync.Once
+		kv.beforeWrite = func(path string) {
+			once.Do(func() {
+				kv.putBundle(t, path, testcert.Generate(t, time.Now().Add(2*time.Hour), "a.myserver.com"))
+			})
+		}
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached.Leaf.Equal(cert.Leaf) {
+			t.Fatal("Expected certificate to overwrite the concurrently stored certificate")
+		}
+	})
+
+	t.Run("It gives up after too many conflicting writes", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		cache.MaxRetries = 2
+		kv.beforeWrite = func(path string) {
+			kv.putBundle(t, path, testcert.Generate(t, time.Now().Add(time.Minute)))
+		}
+
+		err := cache.Put(ctx, "myserver.com", testcert.Generate(t, time.Now().Add(time.Hour)))
+		if err == nil || !strings.Contains(err.Error(), "conflicting writes") {
+			t.Fatalf("Expected conflict error, got %v", err)
+		}
+		if kv.versions("certify/myserver.com") != 3 {
+			t.Fatalf("Expected 3 attempts, got %d", kv.versions("certify/myserver.com"))
+		}
+	})
+
+	t.Run("It reports invalid entries as cache misses", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		if err := kv.put("certify/myserver.com", map[string]interface{}{"bundle": "not a bundle"}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := cache.Get(ctx, "myserver.com")
+		if !errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected ErrCacheMiss, got %v", err)
+		}
+	})
+
+	t.Run("It returns authentication errors", func(t *testing.T) {
+		t.Parallel()
+		cache, _ := newCache(t)
+		cache.AuthMethod = issuer.ConstantToken("wrong")
+
+		_, err := cache.Get(ctx, "myserver.com")
+		if err == nil || errors.Is(err, certify.ErrCacheMiss) {
+			t.Fatalf("Expected permission error, got %v", err)
+		}
+	})
+
+	t.Run("It encrypts private keys", func(t *testing.T) {
+		t.Parallel()
+		cache, kv := newCache(t)
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		cache.Keys, _ = certify.NewKeyring(key)
+		cert := testcert.Generate(t, time.Now().Add(time.Hour))
+
+		if err := cache.Put(ctx, "myserver.com", cert); err != nil {
+			t.Fatal(err)
+		}
+		kv.mu.Lock()
+		stored := kv.secrets["certify/myserver.com"][0]["bundle"].(string)
+		kv.mu.Unlock()
+		if strings.Contains(stored, "EC PRIVATE KEY") || !strings.Contains(stored, "CERTIFY SEALED PRIVATE KEY") {
+			t.Fatalf("Expected private key to be encrypted, got:\n%s", stored)
+		}
+
+		cached, err := cache.Get(ctx, "myserver.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(cached.PrivateKey) {
+			t.Fatal("Unexpected private key returned from cache")
+		}
+	})
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+
+	"github.com/johanbrandhorst/certify/internal/tracing"
 )
 
 // Certify implements automatic certificate acquisition
@@ -34,6 +40,15 @@ type Certify struct {
 	// Cache is the Cache implementation to use.
 	Cache Cache
 
+	// Locker configures a lock shared between instances, held while
+	// issuing a certificate. It prevents instances sharing a Cache
+	// from all issuing a certificate for the same name at the same
+	// time, since instances waiting for the lock find the certificate
+	// issued by the holder in the Cache. Defaults to no locking.
+	// See FileLocker, and the Redis and Kubernetes caches for
+	// implementations.
+	Locker Locker
+
 	// CertConfig is the certificate configuration that
 	// should be used. It can be specified to set explicit
 	// requirements of certificates issued.
@@ -43,13 +58,82 @@ type Certify struct {
 	// per certificate call. Defaults to 1 minute.
 	IssueTimeout time.Duration
 
+	// IssueRateLimit limits the sustained rate of requests, per
+	// second, made to the Issuer. Requests exceeding the limit wait
+	// their turn, until the context of the handshake is done, at which
+	// point ErrIssueLimited is returned. Defaults to no limit.
+	IssueRateLimit rate.Limit
+
+	// IssueBurst is the number of requests allowed to
+	// exceed the IssueRateLimit at once. Defaults to 1.
+	IssueBurst int
+
+	// MaxConcurrentIssues limits the number of concurrent
+	// requests made to the Issuer. Requests exceeding the limit
+	// wait their turn like for IssueRateLimit. Defaults to no limit.
+	MaxConcurrentIssues int
+
+	// HostPolicy controls which server names GetCertificate
+	// will request certificates for. It is consulted before the
+	// cache and the issuer. If unset, any server name is allowed.
+	// See HostWhitelist, HostWildcards and HostRegexp for
+	// some common policies.
+	HostPolicy HostPolicy
+
+	// Wildcards configures wildcard names, of the form
+	// "*.example.com", for which a single wildcard certificate
+	// should be requested and served. Server names matching one
+	// of the wildcards, such as "a.example.com" and "b.example.com",
+	// will all be served the same "*.example.com" certificate
+	// rather than one certificate per name. The HostPolicy is
+	// still applied to the original server name.
+	Wildcards []string
+
+	// Batch configures Certify to maintain a single
+	// certificate covering a set of server names, rather than
+	// one certificate per server name. This reduces the
+	// number of certificates requested from the Issuer when
+	// serving many names. If unset, a certificate is
+	// requested per server name.
+	Batch *SANBatch
+
+	// Variants configures several certificates to be maintained
+	// per name, each with its own KeyGenerator. This can be used
+	// to serve ECDSA certificates to modern clients and RSA
+	// certificates to legacy clients. Each variant is cached and
+	// renewed independently. GetCertificate and GetClientCertificate
+	// return the first variant, in order, that the peer supports,
+	// skipping variants that fail to be issued. If unset, a single certificate is maintained per name, using
+	// the KeyGenerator of the CertConfig.
+	Variants []CertVariant
+
 	// Logger configures logging of events such as renewals.
 	// Defaults to no logging. Use one of the adapters in
 	// https://logur.dev/logur to use with specific
 	// logging libraries, or implement the interface yourself.
 	Logger Logger
 
+	// Metrics configures recording of metrics such as the
+	// latency of requests to the Issuer and cache hit rates.
+	// Defaults to no metrics. See the metrics/prometheus
+	// package for an implementation using Prometheus.
+	Metrics Metrics
+
+	// TracerProvider configures tracing of certificate
+	// requests with OpenTelemetry. Spans are started from
+	// the context of the TLS handshake. Defaults to no tracing.
+	TracerProvider trace.TracerProvider
+
+	// PrewarmConcurrency limits the number of certificates
+	// loaded or issued at once by Prewarm. Defaults to 4.
+	PrewarmConcurrency int
+
+	tracer     trace.Tracer
+	wildcards  []string
+	batch      *nameBatch
+	limiter    *issueLimiter
 	issueGroup singleflight.Group
+	events     events
 	initOnce   sync.Once
 }
 
@@ -60,6 +144,9 @@ func (c *Certify) init() {
 	if c.Logger == nil {
 		c.Logger = &noopLogger{}
 	}
+	if c.Metrics == nil {
+		c.Metrics = &noopMetrics{}
+	}
 	if c.IssueTimeout == 0 {
 		c.IssueTimeout = time.Minute
 	}
@@ -69,27 +156,82 @@ func (c *Certify) init() {
 	if c.CertConfig.KeyGenerator == nil {
 		c.CertConfig.KeyGenerator = &singletonKey{}
 	}
+	for _, w := range c.Wildcards {
+		c.wildcards = append(c.wildcards, normalizeHost(w))
+	}
+	if c.Batch != nil {
+		c.batch = newNameBatch(c.Batch)
+	}
+	c.tracer = tracing.Tracer(c.TracerProvider)
+	c.limiter = newIssueLimiter(c.IssueRateLimit, c.IssueBurst, c.MaxConcurrentIssues)
+}
+
+// wildcardFor returns the configured wildcard name
+// matching name, or name itself if none match.
+func (c *Certify) wildcardFor(name string) string {
+	for _, w := range c.wildcards {
+		if matchWildcard(w, name) {
+			return w
+		}
+	}
+	return name
 }
 
 // GetCertificate implements the GetCertificate TLS config hook.
+// The returned certificate is a copy, which the caller may modify,
+// for example to set its OCSPStaple, without affecting other
+// connections.
 func (c *Certify) GetCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
 	c.initOnce.Do(c.init)
+	ctx, span := c.tracer.Start(getRequestContext(hello), "certify.GetCertificate", trace.WithAttributes(
+		attribute.String("certify.server_name", hello.ServerName),
+	))
 	defer func() {
+		tracing.End(span, err)
 		if err != nil {
 			c.Logger.Error("Error getting server certificate", map[string]interface{}{
-				"error": err.Error(),
+				LogFieldName:  hello.ServerName,
+				LogFieldError: err.Error(),
 			})
 			return
 		}
 	}()
 
-	name := strings.ToLower(hello.ServerName)
+	name, err := serverName(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.HostPolicy != nil {
+		if err := c.HostPolicy(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	name = c.wildcardFor(name)
+	req := nameRequest(name)
+	if c.batch != nil && c.batch.add(name) {
+		req = c.batch.request(c.CommonName, name)
+	}
+
+	return c.getSupportedCert(ctx, req, hello.SupportsCertificate)
+}
+
+// serverName validates and normalizes a server name
+// requested by a client.
+func serverName(name string) (string, error) {
 	if name == "" {
-		return nil, errors.New("missing server name")
+		return "", errors.New("missing server name")
 	}
 	if strings.ContainsAny(name, `/\`) {
-		return nil, errors.New("server name contains invalid character")
+		return "", errors.New("server name contains invalid character")
 	}
+	return normalizeName(name), nil
+}
+
+// normalizeName normalizes a name used as a cache key.
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
 
 	// Remove ending dot, if any
 	name = strings.TrimSuffix(name, ".")
@@ -99,71 +241,264 @@ func (c *Certify) GetCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certific
 		name = strings.Split(name, ":")[0]
 	}
 
-	ctx := getRequestContext(hello)
-	return c.getOrRenewCert(ctx, name)
+	return name
 }
 
 // GetClientCertificate implements the GetClientCertificate TLS config hook.
+// Like with GetCertificate, the returned certificate is a copy.
 func (c *Certify) GetClientCertificate(cri *tls.CertificateRequestInfo) (cert *tls.Certificate, err error) {
 	c.initOnce.Do(c.init)
+	ctx, span := c.tracer.Start(getClientRequestContext(cri), "certify.GetClientCertificate", trace.WithAttributes(
+		attribute.String("certify.common_name", c.CommonName),
+	))
 	defer func() {
+		tracing.End(span, err)
 		if err != nil {
 			c.Logger.Error("Error getting client certificate", map[string]interface{}{
-				"error": err.Error(),
+				LogFieldName:  c.CommonName,
+				LogFieldError: err.Error(),
 			})
 			return
 		}
 	}()
-	ctx := getClientRequestContext(cri)
-	return c.getOrRenewCert(ctx, c.CommonName)
+	return c.getSupportedCert(ctx, c.clientRequest(), cri.SupportsCertificate)
+}
+
+// clientRequest returns the certRequest for the client certificate.
+// Like server names, the CommonName is normalized for the cache key,
+// so that certificates imported for it are found.
+func (c *Certify) clientRequest() certRequest {
+	req := nameRequest(normalizeName(c.CommonName))
+	req.names = []string{c.CommonName}
+	return req
+}
+
+// certRequest describes a certificate that should
+// be fetched from the cache or issued.
+type certRequest struct {
+	// key is the cache key of the certificate.
+	key string
+	// group is the key used to de-duplicate simultaneous issuance.
+	group string
+	// names are added to the SANs of issued certificates.
+	names []string
+	// cover are the names a cached certificate must be valid for
+	// to be used. A batch certificate that doesn't contain every
+	// name of the batch is still used for the names it contains,
+	// until it's replaced by one issued for all names.
+	cover []string
+	// keyGenerator, if set, overrides the KeyGenerator
+	// of the CertConfig.
+	keyGenerator KeyGenerator
+	// supports, if set, reports whether the peer supports a cached
+	// certificate. If it doesn't, the certificate isn't renewed,
+	// and errUnsupportedVariant is returned instead.
+	supports func(*tls.Certificate) error
+}
+
+// errUnsupportedVariant is returned for cached certificates
+// of variants that the peer doesn't support.
+var errUnsupportedVariant = errors.New("certificate variant not supported by peer")
+
+// variant returns a copy of the certRequest for the variant.
+func (r certRequest) variant(v CertVariant) certRequest {
+	r.key += "+" + v.Name
+	r.group += "+" + v.Name
+	r.keyGenerator = v.KeyGenerator
+	return r
+}
+
+// nameRequest returns the certRequest for a certificate
+// issued for a single name.
+func nameRequest(name string) certRequest {
+	return certRequest{
+		key:   name,
+		group: name,
+		names: []string{name},
+	}
+}
+
+// getSupportedCert returns the certificate for the request,
+// or if Variants are configured, the first variant that
+// is supported according to supports. Variants that fail
+// to be issued are skipped, so that peers supporting
+// later variants can still be served.
+func (c *Certify) getSupportedCert(ctx context.Context, req certRequest, supports func(*tls.Certificate) error) (*tls.Certificate, error) {
+	if len(c.Variants) == 0 {
+		return c.getOrRenewCert(ctx, req)
+	}
+
+	var err error
+	for _, v := range c.Variants {
+		vReq := req.variant(v)
+		vReq.supports = supports
+		var cert *tls.Certificate
+		cert, err = c.getOrRenewCert(ctx, vReq)
+		if err == nil {
+			if err = supports(cert); err == nil {
+				return cert, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.Logger.Debug("Certificate variant not usable for peer", map[string]interface{}{
+			LogFieldName:  req.key,
+			"variant":     v.Name,
+			LogFieldError: err.Error(),
+		})
+	}
+
+	return nil, fmt.Errorf("no certificate variant usable for peer: %w", err)
 }
 
-func (c *Certify) getOrRenewCert(ctx context.Context, name string) (*tls.Certificate, error) {
+func (c *Certify) getOrRenewCert(ctx context.Context, req certRequest) (*tls.Certificate, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.IssueTimeout)
 	defer cancel()
 
-	cert, err := c.Cache.Get(ctx, name)
+	renewing := false
+	cert, err := c.cacheGet(ctx, req.key)
+	if err == nil && req.supports != nil && req.supports(cert) != nil {
+		// Don't renew certificates the peer can't use
+		return nil, errUnsupportedVariant
+	}
 	if err == nil {
 		// If we're not within the renewal threshold of the expiry, return the cert
 		if time.Now().Before(cert.Leaf.NotAfter.Add(-c.RenewBefore)) {
-			return cert, nil
+			if coversNames(cert.Leaf, req.cover) {
+				c.Metrics.SetCertExpiry(req.key, cert.Leaf.NotAfter)
+				return copyCertificate(cert), nil
+			}
+			// The certificate is still valid for the names it
+			// contains, so it's kept for them until it's replaced.
+			c.Logger.Debug("Cached certificate found but missing requested names", map[string]interface{}{
+				LogFieldName:   req.key,
+				LogFieldSerial: cert.Leaf.SerialNumber.String(),
+				"names":        strings.Join(req.cover, ","),
+			})
+		} else {
+			c.Logger.Debug("Cached certificate found but expiry within renewal threshold", map[string]interface{}{
+				LogFieldName:   req.key,
+				LogFieldSerial: cert.Leaf.SerialNumber.String(),
+				LogFieldExpiry: cert.Leaf.NotAfter.Format(time.RFC3339),
+			})
+			c.events.certExpiringSoon(req.key, cert.Leaf)
+			if c.Locker == nil {
+				// Delete the cert, we want to renew it. With a Locker, it's
+				// replaced once renewed instead, as another instance could
+				// have renewed it since it was read.
+				_ = c.cacheDelete(ctx, req.key)
+			}
 		}
-		c.Logger.Debug("Cached certificate found but expiry within renewal threshold", map[string]interface{}{
-			"serial": cert.Leaf.SerialNumber.String(),
-			"expiry": cert.Leaf.NotAfter.Format(time.RFC3339),
-		})
-		// Delete the cert, we want to renew it
-		_ = c.Cache.Delete(ctx, name)
-	} else if err != ErrCacheMiss {
+		renewing = true
+	} else if !errors.Is(err, ErrCacheMiss) {
+		c.events.error(req.key, err)
 		return nil, err
+	} else if err != ErrCacheMiss {
+		// The cache has more to say about the miss
+		c.Logger.Warn("Unusable certificate found in cache", map[string]interface{}{
+			LogFieldName:  req.key,
+			LogFieldError: err.Error(),
+		})
 	}
 
-	// De-duplicate simultaneous requests for the same name
-	ch := c.issueGroup.DoChan(name, func() (interface{}, error) {
-		c.Logger.Debug("Requesting new certificate from issuer")
+	// De-duplicate simultaneous requests for the same name.
+	// Only the function of the first request is called, so
+	// leader is only set for that request.
+	var leader bool
+	ch := c.issueGroup.DoChan(req.group, func() (interface{}, error) {
+		leader = true
+		c.Logger.Debug("Requesting new certificate from issuer", map[string]interface{}{
+			LogFieldName:   req.key,
+			LogFieldIssuer: issuerName(c.Issuer),
+		})
 		conf := c.CertConfig.Clone()
-		conf.appendName(name)
+		if req.keyGenerator != nil {
+			conf.KeyGenerator = req.keyGenerator
+		}
+		hasCommonName := false
+		for _, name := range req.names {
+			conf.appendName(name)
+			if name == c.CommonName {
+				hasCommonName = true
+			}
+		}
 
 		// Add CommonName to SANS if not already added
-		if name != c.CommonName {
+		if !hasCommonName {
 			conf.appendName(c.CommonName)
 		}
 
-		cert, err := c.Issuer.Issue(ctx, c.CommonName, conf)
+		if c.Locker != nil {
+			unlock, err := c.lock(ctx, req.key)
+			if err != nil {
+				c.events.error(req.key, err)
+				return nil, err
+			}
+			defer unlock()
+
+			// Another instance may have issued the certificate while we
+			// waited, which a miss remembered by the cache doesn't know
+			cert, err := c.cacheGet(skipNegativeCache(ctx), req.key)
+			if err == nil && c.fresh(cert, req) {
+				c.Logger.Debug("Certificate issued by another instance found in cache", map[string]interface{}{
+					LogFieldName:   req.key,
+					LogFieldSerial: cert.Leaf.SerialNumber.String(),
+				})
+				c.Metrics.SetCertExpiry(req.key, cert.Leaf.NotAfter)
+				return cert, nil
+			}
+		}
+
+		release, err := c.limiter.acquire(ctx)
+		if err != nil {
+			c.events.error(req.key, err)
+			return nil, err
+		}
+		start := time.Now()
+		issueCtx, span := c.tracer.Start(ctx, "certify.Issuer.Issue", trace.WithAttributes(
+			attribute.String("certify.issuer", issuerName(c.Issuer)),
+			attribute.StringSlice("certify.names", req.names),
+		))
+		cert, err := c.Issuer.Issue(issueCtx, c.CommonName, conf)
+		tracing.End(span, err)
+		release()
+		dur := time.Since(start)
+		c.Metrics.ObserveIssue(issuerName(c.Issuer), dur, err)
 		if err != nil {
+			c.Logger.Warn("Failed to issue certificate", map[string]interface{}{
+				LogFieldName:     req.key,
+				LogFieldIssuer:   issuerName(c.Issuer),
+				LogFieldDuration: dur,
+				LogFieldError:    err.Error(),
+			})
+			c.events.error(req.key, err)
 			return nil, err
 		}
 
 		c.Logger.Debug("New certificate issued", map[string]interface{}{
-			"serial": cert.Leaf.SerialNumber.String(),
-			"expiry": cert.Leaf.NotAfter.Format(time.RFC3339),
+			LogFieldName:     req.key,
+			LogFieldIssuer:   issuerName(c.Issuer),
+			LogFieldSerial:   cert.Leaf.SerialNumber.String(),
+			LogFieldExpiry:   cert.Leaf.NotAfter.Format(time.RFC3339),
+			LogFieldDuration: dur,
 		})
 
-		err = c.Cache.Put(ctx, name, cert)
+		if renewing {
+			c.events.renewedCert(req.key, cert.Leaf)
+		} else {
+			c.events.issuedCert(req.key, cert.Leaf)
+		}
+
+		c.Metrics.SetCertExpiry(req.key, cert.Leaf.NotAfter)
+		err = c.cachePut(ctx, req.key, cert)
 		if err != nil {
 			c.Logger.Error("Failed to save certificate in cache", map[string]interface{}{
-				"error": err.Error(),
+				LogFieldName:   req.key,
+				LogFieldSerial: cert.Leaf.SerialNumber.String(),
+				LogFieldError:  err.Error(),
 			})
+			c.events.error(req.key, err)
 			// Ignore error, it'll just mean we renew again next time
 		}
 
@@ -174,9 +509,105 @@ func (c *Certify) getOrRenewCert(ctx context.Context, name string) (*tls.Certifi
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case res := <-ch:
+		if !leader {
+			c.Metrics.ObserveIssueCollapsed()
+		}
 		if res.Err != nil {
 			return nil, res.Err
 		}
-		return res.Val.(*tls.Certificate), nil
+		// The certificate is shared with the cache and other requests
+		return copyCertificate(res.Val.(*tls.Certificate)), nil
+	}
+}
+
+// fresh reports whether the certificate can be used for the
+// request, without renewing it.
+func (c *Certify) fresh(cert *tls.Certificate, req certRequest) bool {
+	if !time.Now().Before(cert.Leaf.NotAfter.Add(-c.RenewBefore)) {
+		return false
+	}
+	return coversNames(cert.Leaf, req.cover)
+}
+
+// lock acquires the lock for the key from the Locker,
+// returning a function releasing it.
+func (c *Certify) lock(ctx context.Context, key string) (func(), error) {
+	ctx, span := c.tracer.Start(ctx, "certify.Locker.Lock", trace.WithAttributes(
+		attribute.String("certify.cache_key", key),
+	))
+	start := time.Now()
+	unlock, err := c.Locker.Lock(ctx, key)
+	tracing.End(span, err)
+	if err != nil {
+		c.Logger.Error("Failed to acquire issuance lock", map[string]interface{}{
+			LogFieldName:     key,
+			LogFieldDuration: time.Since(start),
+			LogFieldError:    err.Error(),
+		})
+		return nil, err
+	}
+	c.Logger.Debug("Acquired issuance lock", map[string]interface{}{
+		LogFieldName:     key,
+		LogFieldDuration: time.Since(start),
+	})
+
+	return func() {
+		if err := unlock(); err != nil {
+			c.Logger.Warn("Failed to release issuance lock", map[string]interface{}{
+				LogFieldName:  key,
+				LogFieldError: err.Error(),
+			})
+		}
+	}, nil
+}
+
+func (c *Certify) cacheGet(ctx context.Context, key string) (*tls.Certificate, error) {
+	ctx, span := c.tracer.Start(ctx, "certify.Cache.Get", trace.WithAttributes(
+		attribute.String("certify.cache_key", key),
+	))
+	cert, err := c.Cache.Get(ctx, key)
+	switch {
+	case err == nil:
+		c.Metrics.ObserveCache(CacheOpGet, CacheResultHit)
+		span.SetAttributes(attribute.Bool("certify.cache_hit", true))
+		tracing.End(span, nil)
+	case errors.Is(err, ErrCacheMiss):
+		c.Metrics.ObserveCache(CacheOpGet, CacheResultMiss)
+		span.SetAttributes(attribute.Bool("certify.cache_hit", false))
+		tracing.End(span, nil)
+	default:
+		c.Metrics.ObserveCache(CacheOpGet, CacheResultError)
+		tracing.End(span, err)
+	}
+	return cert, err
+}
+
+func (c *Certify) cachePut(ctx context.Context, key string, cert *tls.Certificate) error {
+	ctx, span := c.tracer.Start(ctx, "certify.Cache.Put", trace.WithAttributes(
+		attribute.String("certify.cache_key", key),
+	))
+	err := c.Cache.Put(ctx, key, cert)
+	tracing.End(span, err)
+	c.Metrics.ObserveCache(CacheOpPut, cacheResult(err))
+	return err
+}
+
+func (c *Certify) cacheDelete(ctx context.Context, key string) error {
+	ctx, span := c.tracer.Start(ctx, "certify.Cache.Delete", trace.WithAttributes(
+		attribute.String("certify.cache_key", key),
+	))
+	err := c.Cache.Delete(ctx, key)
+	tracing.End(span, err)
+	c.Metrics.ObserveCache(CacheOpDelete, cacheResult(err))
+	if err == nil {
+		c.Metrics.DeleteCertExpiry(key)
+	}
+	return err
+}
+
+func cacheResult(err error) string {
+	if err != nil {
+		return CacheResultError
 	}
+	return CacheResultSuccess
 }
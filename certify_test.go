@@ -15,12 +15,18 @@ import (
 	"math/big"
 	"net"
 	"net/url"
+	"os"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/onsi/gomega/gstruct"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/time/rate"
 
 	"github.com/johanbrandhorst/certify"
 	"github.com/johanbrandhorst/certify/mocks"
@@ -42,7 +48,25 @@ var _ = Describe("Caches", func() {
 		Cache certify.Cache
 	}{
 		{Type: "MemCache", Cache: certify.NewMemCache()},
+		{Type: "bounded MemCache", Cache: certify.NewMemCache(
+			certify.MemCacheMaxEntries(10),
+			certify.MemCacheEvictExpired(),
+		)},
 		{Type: "DirCache", Cache: certify.DirCache(mustMakeTempDir())},
+		{Type: "LoggingCache", Cache: &certify.LoggingCache{
+			Cache: certify.DirCache(mustMakeTempDir()),
+		}},
+		{Type: "EncryptedCache", Cache: &certify.EncryptedCache{
+			Cache: certify.DirCache(mustMakeTempDir()),
+			Keys:  mustMakeKeyring(),
+		}},
+		{Type: "TieredCache", Cache: certify.TieredCache(
+			certify.NewMemCache(),
+			certify.DirCache(mustMakeTempDir()),
+		)},
+		{Type: "CopyingCache", Cache: &certify.CopyingCache{
+			Cache: certify.NewMemCache(),
+		}},
 	}
 
 	keyFuncs := map[string]keyGeneratorFunc{
@@ -84,6 +108,36 @@ var _ = Describe("Caches", func() {
 				})
 			})
 
+			if _, ok := c.Cache.(certify.ListableCache); ok {
+				Context("when listing certificates", func() {
+					It("returns the names and metadata of the certificates", func() {
+						lc := c.Cache.(certify.ListableCache)
+						cert1, err := generateCertAndKey("localhost", net.IPv4(127, 0, 0, 1), keyFuncs["ecdsa"])
+						Expect(err).To(Succeed())
+						cert2, err := generateCertAndKey("otherhost", net.IPv4(127, 0, 0, 2), keyFuncs["ecdsa"])
+						Expect(err).To(Succeed())
+						Expect(lc.Put(context.Background(), "key2", cert2)).To(Succeed())
+						Expect(lc.Put(context.Background(), "key1", cert1)).To(Succeed())
+
+						entries, err := lc.List(context.Background())
+						Expect(err).To(Succeed())
+						Expect(entries).To(HaveLen(2))
+						for i, cert := range []*tls.Certificate{cert1, cert2} {
+							Expect(entries[i].Name).To(Equal(fmt.Sprintf("key%d", i+1)))
+							Expect(entries[i].SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+							Expect(entries[i].Issuer.CommonName).To(Equal("Certify Test Cert"))
+							Expect(entries[i].NotAfter).To(BeTemporally("==", cert.Leaf.NotAfter))
+							Expect(entries[i].DNSNames).To(Equal(cert.Leaf.DNSNames))
+							Expect(entries[i].IPAddresses[0].Equal(cert.Leaf.IPAddresses[0])).To(BeTrue())
+						}
+
+						Expect(lc.Delete(context.Background(), "key1")).To(Succeed())
+						Expect(lc.Delete(context.Background(), "key2")).To(Succeed())
+						Expect(lc.List(context.Background())).To(BeEmpty())
+					})
+				})
+			}
+
 			Context("when accessing the cache concurrently", func() {
 				It("does not cause any race conditions", func() {
 					start := make(chan struct{})
@@ -360,9 +414,11 @@ var _ = Describe("Certify", func() {
 	Context("when several requests are made at the same time", func() {
 		It("only calls to the issuer once", func() {
 			issuer := &mocks.IssuerMock{}
+			metrics := &recordingMetrics{expiry: map[string]time.Time{}}
 			cli := &certify.Certify{
 				CommonName: "myserver.com",
 				Issuer:     issuer,
+				Metrics:    metrics,
 			}
 			wait := make(chan struct{})
 			issuer.IssueFunc = func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
@@ -409,10 +465,1016 @@ var _ = Describe("Certify", func() {
 			Eventually(gr2).Should(BeClosed())
 
 			Expect(issuer.IssueCalls()).To(HaveLen(1))
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			Expect(metrics.collapsed).To(Equal(1))
+		})
+	})
+
+	Context("when a Locker is configured", func() {
+		It("only issues a certificate from one of the instances sharing the cache", func() {
+			dir, err := ioutil.TempDir("", "")
+			Expect(err).To(Succeed())
+			defer os.RemoveAll(dir)
+
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					time.Sleep(50 * time.Millisecond)
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(100),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			cache := certify.NewMemCache()
+			instances := make([]*certify.Certify, 3)
+			for i := range instances {
+				instances[i] = &certify.Certify{
+					CommonName: "myserver.com",
+					Issuer:     issuer,
+					Cache:      cache,
+					Locker:     &certify.FileLocker{Dir: dir},
+				}
+			}
+
+			var wg sync.WaitGroup
+			for _, cli := range instances {
+				wg.Add(1)
+				go func(cli *certify.Certify) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					cert, err := cli.GetClientCertificate(&tls.CertificateRequestInfo{})
+					Expect(err).To(Succeed())
+					Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(100))
+				}(cli)
+			}
+			wg.Wait()
+
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+		})
+
+		It("finds certificates issued by another instance behind a TieredCache", func() {
+			dir, err := ioutil.TempDir("", "")
+			Expect(err).To(Succeed())
+			defer os.RemoveAll(dir)
+
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					time.Sleep(100 * time.Millisecond)
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(100),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			shared := certify.NewMemCache()
+			instances := make([]*certify.Certify, 2)
+			for i := range instances {
+				instances[i] = &certify.Certify{
+					CommonName: "myserver.com",
+					Issuer:     issuer,
+					// The miss in the shared cache is remembered by each instance
+					Cache:  certify.TieredCache(certify.NewMemCache(), shared),
+					Locker: &certify.FileLocker{Dir: dir},
+				}
+			}
+
+			var wg sync.WaitGroup
+			for _, cli := range instances {
+				wg.Add(1)
+				go func(cli *certify.Certify) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					cert, err := cli.GetClientCertificate(&tls.CertificateRequestInfo{})
+					Expect(err).To(Succeed())
+					Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(100))
+				}(cli)
+			}
+			wg.Wait()
+
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+		})
+	})
+
+	Context("when the returned certificate is modified", func() {
+		It("does not affect the cached certificate or other handshakes", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			cache := certify.NewMemCache()
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      cache,
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					cert, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "myserver.com"})
+					Expect(err).To(Succeed())
+					Expect(cert.OCSPStaple).To(BeEmpty())
+					cert.OCSPStaple = []byte{byte(i)}
+					cert.Leaf.SerialNumber = big.NewInt(int64(i))
+				}(i)
+			}
+			wg.Wait()
+
+			cached, err := cache.Get(context.Background(), "myserver.com")
+			Expect(err).To(Succeed())
+			Expect(cached.OCSPStaple).To(BeEmpty())
+			Expect(cached.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(123456))
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+		})
+	})
+
+	Context("when a HostPolicy is configured", func() {
+		It("rejects server names not allowed by the policy", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				HostPolicy: certify.HostWhitelist("Allowed.com."),
+			}
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: "notallowed.com",
+			})
+			Expect(err).To(MatchError(ContainSubstring("not configured in HostWhitelist")))
+			Expect(issuer.IssueCalls()).To(BeEmpty())
+
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: "allowed.com",
+			})
+			Expect(err).To(Succeed())
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+		})
+	})
+
+	Context("when Wildcards are configured", func() {
+		It("serves a single wildcard certificate for matching names", func() {
+			issuer := &mocks.IssuerMock{}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+				Wildcards:  []string{"*.svc.example.com"},
+			}
+			issuer.IssueFunc = func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+				defer GinkgoRecover()
+				Expect(in3.SubjectAlternativeNames).To(Equal([]string{"*.svc.example.com", cli.CommonName}))
+				return &tls.Certificate{
+					Leaf: &x509.Certificate{
+						SerialNumber: big.NewInt(123456),
+						NotAfter:     time.Now().Add(time.Hour),
+					},
+				}, nil
+			}
+
+			cert1, err := cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: "a.svc.example.com",
+			})
+			Expect(err).To(Succeed())
+			cert2, err := cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: "B.svc.example.com",
+			})
+			Expect(err).To(Succeed())
+			Expect(cert2).To(Equal(cert1))
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+
+			By("issuing separately for names that don't match")
+			issuer.IssueFunc = func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+				defer GinkgoRecover()
+				Expect(in3.SubjectAlternativeNames).To(Equal([]string{"a.b.svc.example.com", cli.CommonName}))
+				return &tls.Certificate{
+					Leaf: &x509.Certificate{
+						SerialNumber: big.NewInt(123457),
+						NotAfter:     time.Now().Add(time.Hour),
+					},
+				}, nil
+			}
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: "a.b.svc.example.com",
+			})
+			Expect(err).To(Succeed())
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+		})
+	})
+
+	Context("when a Batch is configured", func() {
+		It("issues a single certificate covering all names in the batch", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+							DNSNames:     in3.SubjectAlternativeNames,
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+				Batch: &certify.SANBatch{
+					Names:    []string{"a.example.com"},
+					Discover: true,
+					MaxNames: 2,
+				},
+			}
+
+			for _, name := range []string{"a.example.com", "a.example.com"} {
+				_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+				Expect(err).To(Succeed())
+			}
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+			Expect(issuer.IssueCalls()[0].In3.SubjectAlternativeNames).To(Equal([]string{"a.example.com", cli.CommonName}))
+
+			By("reissuing when a new name is discovered")
+			cert, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.DNSNames).To(ConsistOf("a.example.com", "b.example.com", cli.CommonName))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			cert2, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert2).To(Equal(cert))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			By("issuing separately once the batch is full")
+			cert, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.DNSNames).To(Equal([]string{"c.example.com", cli.CommonName}))
+			Expect(issuer.IssueCalls()).To(HaveLen(3))
+		})
+
+		It("keeps serving the batch certificate while a discovered name is issued", func() {
+			var fail int32
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					if atomic.LoadInt32(&fail) == 1 {
+						return nil, errors.New("issuer unavailable")
+					}
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(int64(len(in3.SubjectAlternativeNames))),
+							NotAfter:     time.Now().Add(time.Hour),
+							DNSNames:     in3.SubjectAlternativeNames,
+						},
+					}, nil
+				},
+			}
+			cache := certify.NewMemCache()
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      cache,
+				Batch: &certify.SANBatch{
+					Names:    []string{"a.example.com"},
+					Discover: true,
+				},
+			}
+
+			cert, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.DNSNames).To(ConsistOf("a.example.com", cli.CommonName))
+
+			atomic.StoreInt32(&fail, 1)
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+			Expect(err).To(MatchError("issuer unavailable"))
+
+			By("serving the previous certificate to the names it covers")
+			cert2, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert2).To(Equal(cert))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			By("replacing it once the discovered name is issued")
+			atomic.StoreInt32(&fail, 0)
+			cert, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.DNSNames).To(ConsistOf("a.example.com", "b.example.com", cli.CommonName))
+			cert2, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			Expect(err).To(Succeed())
+			Expect(cert2).To(Equal(cert))
+			Expect(issuer.IssueCalls()).To(HaveLen(3))
+		})
+	})
+
+	Context("when Variants are configured", func() {
+		It("serves the first variant supported by the client", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return generateCertAndKey(in3.SubjectAlternativeNames[0], net.IPv4(127, 0, 0, 1), in3.KeyGenerator.Generate)
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+				Variants: []certify.CertVariant{
+					{Name: "ecdsa", KeyGenerator: keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+						return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					})},
+					{Name: "rsa", KeyGenerator: keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+						return rsa.GenerateKey(rand.Reader, 2048)
+					})},
+				},
+			}
+
+			modern := &tls.ClientHelloInfo{
+				ServerName:        "example.com",
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+			}
+			legacy := &tls.ClientHelloInfo{
+				ServerName:        "example.com",
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.CurveP256},
+				SupportedPoints:   []uint8{0},
+			}
+
+			cert, err := cli.GetCertificate(modern)
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}))
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+
+			cert, err = cli.GetCertificate(legacy)
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			By("caching each variant independently")
+			cert, err = cli.GetCertificate(legacy)
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+			cert, err = cli.GetCertificate(modern)
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			By("not renewing variants the client doesn't support")
+			cli.RenewBefore = time.Until(cert.Leaf.NotAfter) + time.Minute
+			cert, err = cli.GetCertificate(legacy)
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+			Expect(issuer.IssueCalls()).To(HaveLen(3))
+		})
+
+		It("serves a later variant if an earlier one fails to be issued", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					key, err := in3.KeyGenerator.Generate()
+					if err != nil {
+						return nil, err
+					}
+					if _, ok := key.(*ecdsa.PrivateKey); ok {
+						return nil, errors.New("ECDSA not supported")
+					}
+					return generateCertAndKey(in3.SubjectAlternativeNames[0], net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+						return key, nil
+					})
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+				Variants: []certify.CertVariant{
+					{Name: "ecdsa", KeyGenerator: keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+						return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					})},
+					{Name: "rsa", KeyGenerator: keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+						return rsa.GenerateKey(rand.Reader, 2048)
+					})},
+				},
+			}
+
+			cert, err := cli.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:        "example.com",
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+			})
+			Expect(err).To(Succeed())
+			Expect(cert.PrivateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+			Expect(issuer.IssueCalls()).To(HaveLen(2))
+
+			By("failing once every variant has failed")
+			cli.Variants = cli.Variants[:1]
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+			Expect(err).To(MatchError(ContainSubstring("ECDSA not supported")))
 		})
 	})
+
+	Context("when IssueRateLimit is configured", func() {
+		It("limits the rate of requests to the issuer", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName:     "myserver.com",
+				Issuer:         issuer,
+				IssueRateLimit: rate.Every(time.Hour),
+			}
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+			Expect(err).To(Succeed())
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+			Expect(err).To(MatchError(certify.ErrIssueLimited))
+			Expect(issuer.IssueCalls()).To(HaveLen(1))
+		})
+	})
+
+	Context("when a Logger is configured", func() {
+		It("logs events with consistent fields", func() {
+			logger := &recordingLogger{}
+			issueErr := errors.New("issuer unavailable")
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					if in3.SubjectAlternativeNames[0] == "fail.example.com" {
+						return nil, issueErr
+					}
+					return generateCertAndKey(in3.SubjectAlternativeNames[0], net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+						return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					})
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache: &certify.LoggingCache{
+					Cache:  certify.NewMemCache(),
+					Logger: logger,
+				},
+				Logger: logger,
+			}
+
+			By("logging a cache miss and the issued certificate")
+			cert, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+			Expect(logger.entry("Certificate not found in cache")).To(HaveKeyWithValue(certify.LogFieldName, "example.com"))
+			issued := logger.entry("New certificate issued")
+			Expect(issued).To(HaveKeyWithValue(certify.LogFieldName, "example.com"))
+			Expect(issued).To(HaveKeyWithValue(certify.LogFieldIssuer, "*mocks.IssuerMock"))
+			Expect(issued).To(HaveKeyWithValue(certify.LogFieldSerial, cert.Leaf.SerialNumber.String()))
+			Expect(issued).To(HaveKeyWithValue(certify.LogFieldExpiry, cert.Leaf.NotAfter.Format(time.RFC3339)))
+			Expect(issued).To(HaveKey(certify.LogFieldDuration))
+
+			By("logging a cache hit")
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+			hit := logger.entry("Certificate found in cache")
+			Expect(hit).To(HaveKeyWithValue(certify.LogFieldName, "example.com"))
+			Expect(hit).To(HaveKeyWithValue(certify.LogFieldSerial, cert.Leaf.SerialNumber.String()))
+
+			By("logging a failure to issue")
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "fail.example.com"})
+			Expect(err).To(MatchError(issueErr))
+			failed := logger.entry("Failed to issue certificate")
+			Expect(failed).To(HaveKeyWithValue(certify.LogFieldName, "fail.example.com"))
+			Expect(failed).To(HaveKeyWithValue(certify.LogFieldIssuer, "*mocks.IssuerMock"))
+			Expect(failed).To(HaveKeyWithValue(certify.LogFieldError, issueErr.Error()))
+			Expect(failed).To(HaveKey(certify.LogFieldDuration))
+			Expect(logger.entry("Error getting server certificate")).To(HaveKeyWithValue(certify.LogFieldName, "fail.example.com"))
+		})
+	})
+
+	Context("when Metrics are configured", func() {
+		It("records issuance and cache metrics", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			metrics := &recordingMetrics{expiry: map[string]time.Time{}}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+				Metrics:    metrics,
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+				Expect(err).To(Succeed())
+			}
+
+			metrics.mu.Lock()
+			Expect(metrics.issues).To(Equal([]string{"*mocks.IssuerMock"}))
+			Expect(metrics.cacheOps).To(Equal([]string{"get/miss", "put/success", "get/hit"}))
+			Expect(metrics.expiry).To(HaveKey("example.com"))
+			metrics.mu.Unlock()
+
+			By("forgetting the expiry of deleted certificates")
+			cli.RenewBefore = 2 * time.Hour
+			issuer.IssueFunc = func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+				return nil, errors.New("issuer unavailable")
+			}
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(HaveOccurred())
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			Expect(metrics.expiry).NotTo(HaveKey("example.com"))
+		})
+
+		It("identifies named issuers by their name", func() {
+			metrics := &recordingMetrics{expiry: map[string]time.Time{}}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer: &certify.NamedIssuer{
+					Name: "vault-eu",
+					Issuer: &mocks.IssuerMock{
+						IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+							return nil, errors.New("issuer unavailable")
+						},
+					},
+				},
+				Metrics: metrics,
+			}
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(HaveOccurred())
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			Expect(metrics.issues).To(Equal([]string{"vault-eu"}))
+		})
+	})
+
+	Context("when a TracerProvider is configured", func() {
+		It("records spans for the handshake, cache and issuer", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			sr := tracetest.NewSpanRecorder()
+			cli := &certify.Certify{
+				CommonName:     "myserver.com",
+				Issuer:         issuer,
+				Cache:          certify.NewMemCache(),
+				TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)),
+			}
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+
+			spans := sr.Ended()
+			var names []string
+			for _, span := range spans {
+				names = append(names, span.Name())
+			}
+			Expect(names).To(Equal([]string{
+				"certify.Cache.Get",
+				"certify.Issuer.Issue",
+				"certify.Cache.Put",
+				"certify.GetCertificate",
+			}))
+			root := spans[len(spans)-1]
+			for _, span := range spans[:len(spans)-1] {
+				Expect(span.SpanContext().TraceID()).To(Equal(root.SpanContext().TraceID()))
+				Expect(span.Parent().SpanID()).To(Equal(root.SpanContext().SpanID()))
+			}
+		})
+	})
+
+	Context("when prewarming certificates", func() {
+		It("loads or issues the certificates with bounded parallelism", func() {
+			var inFlight, maxInFlight int32
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					n := atomic.AddInt32(&inFlight, 1)
+					defer atomic.AddInt32(&inFlight, -1)
+					for {
+						m := atomic.LoadInt32(&maxInFlight)
+						if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Hour),
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName:         "myserver.com",
+				Issuer:             issuer,
+				Cache:              certify.NewMemCache(),
+				HostPolicy:         certify.HostWildcards("*.example.com", "*.b.example.com"),
+				Wildcards:          []string{"*.b.example.com"},
+				PrewarmConcurrency: 2,
+			}
+
+			results := cli.Prewarm(context.Background(),
+				"a.example.com",
+				"x.b.example.com",
+				"y.b.example.com",
+				"example.org",
+				"c.example.com",
+			)
+			Expect(results).To(HaveLen(6))
+			var names []string
+			for _, res := range results {
+				names = append(names, res.Name)
+			}
+			Expect(names).To(Equal([]string{
+				"myserver.com",
+				"a.example.com",
+				"x.b.example.com",
+				"y.b.example.com",
+				"example.org",
+				"c.example.com",
+			}))
+			for i, res := range results {
+				if res.Name == "example.org" {
+					Expect(res.Err).To(HaveOccurred())
+					continue
+				}
+				Expect(res.Err).To(Succeed(), "result %d", i)
+				Expect(res.Certificate).NotTo(BeNil())
+			}
+			Expect(results[2].Certificate).To(BeIdenticalTo(results[3].Certificate))
+
+			// One each for the CommonName, a, *.b and c
+			Expect(issuer.IssueCalls()).To(HaveLen(4))
+			Expect(atomic.LoadInt32(&maxInFlight)).To(BeNumerically("<=", 2))
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "y.b.example.com"})
+			Expect(err).To(Succeed())
+			_, err = cli.GetClientCertificate(&tls.CertificateRequestInfo{})
+			Expect(err).To(Succeed())
+			Expect(issuer.IssueCalls()).To(HaveLen(4))
+		})
+	})
+
+	Context("when event handlers are registered", func() {
+		It("notifies them of issuance, renewal and errors", func() {
+			fail := false
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					if fail {
+						return nil, errors.New("sealed")
+					}
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Minute),
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName:  "myserver.com",
+				Issuer:      issuer,
+				Cache:       certify.NewMemCache(),
+				RenewBefore: time.Hour,
+			}
+			events := make(chan string, 10)
+			cli.OnIssued(func(name string, cert *x509.Certificate) {
+				events <- "issued " + name
+			})
+			cli.OnRenewed(func(name string, cert *x509.Certificate) {
+				events <- "renewed " + name
+			})
+			cli.OnExpiringSoon(func(name string, cert *x509.Certificate) {
+				events <- "expiring " + name
+			})
+			cli.OnError(func(name string, err error) {
+				events <- "error " + name + ": " + err.Error()
+			})
+
+			_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+			Eventually(events).Should(Receive(Equal("issued example.com")))
+
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+			Eventually(events).Should(Receive(Equal("expiring example.com")))
+			Eventually(events).Should(Receive(Equal("renewed example.com")))
+
+			fail = true
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(MatchError("sealed"))
+			Eventually(events).Should(Receive(Equal("expiring example.com")))
+			Eventually(events).Should(Receive(Equal("error example.com: sealed")))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("notifies them once of a certificate expiring while it's renewed", func() {
+			dir, err := ioutil.TempDir("", "")
+			Expect(err).To(Succeed())
+			defer os.RemoveAll(dir)
+
+			fail := false
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					if fail {
+						return nil, errors.New("sealed")
+					}
+					return &tls.Certificate{
+						Leaf: &x509.Certificate{
+							SerialNumber: big.NewInt(123456),
+							NotAfter:     time.Now().Add(time.Minute),
+						},
+					}, nil
+				},
+			}
+			cli := &certify.Certify{
+				CommonName:  "myserver.com",
+				Issuer:      issuer,
+				Cache:       certify.NewMemCache(),
+				Locker:      &certify.FileLocker{Dir: dir},
+				RenewBefore: time.Hour,
+			}
+			events := make(chan string, 10)
+			cli.OnExpiringSoon(func(name string, cert *x509.Certificate) {
+				events <- "expiring " + name
+			})
+
+			_, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			Expect(err).To(Succeed())
+
+			fail = true
+			for i := 0; i < 3; i++ {
+				_, _ = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			}
+			Eventually(events).Should(Receive(Equal("expiring example.com")))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("drops events while too many are pending", func() {
+			issuer := &mocks.IssuerMock{
+				IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+					return nil, errors.New("sealed")
+				},
+			}
+			cli := &certify.Certify{
+				CommonName: "myserver.com",
+				Issuer:     issuer,
+				Cache:      certify.NewMemCache(),
+			}
+			block := make(chan struct{})
+			calls := make(chan struct{}, 2000)
+			cli.OnError(func(name string, err error) {
+				calls <- struct{}{}
+				<-block
+			})
+
+			for i := 0; i < 1100; i++ {
+				_, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+				Expect(err).To(MatchError("sealed"))
+			}
+			Expect(cli.DroppedEvents()).To(BeNumerically(">", 0))
+			close(block)
+			Eventually(func() int { return len(calls) }).Should(Equal(1100 - int(cli.DroppedEvents())))
+		})
+	})
+})
+
+var _ = Describe("LimitIssuer", func() {
+	It("limits concurrent requests to the issuer", func() {
+		wait := make(chan struct{})
+		issuer := &mocks.IssuerMock{
+			IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+				<-wait
+				return &tls.Certificate{
+					Leaf: &x509.Certificate{
+						SerialNumber: big.NewInt(123456),
+						NotAfter:     time.Now().Add(time.Hour),
+					},
+				}, nil
+			},
+		}
+		l := &certify.LimitIssuer{
+			Issuer:      issuer,
+			MaxInFlight: 1,
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			_, err := l.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+		}()
+		Eventually(issuer.IssueCalls).Should(HaveLen(1))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := l.Issue(ctx, "myserver.com", &certify.CertConfig{})
+		Expect(err).To(MatchError(certify.ErrIssueLimited))
+		Expect(issuer.IssueCalls()).To(HaveLen(1))
+
+		close(wait)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("limits the rate of requests to the issuer", func() {
+		issuer := &mocks.IssuerMock{
+			IssueFunc: func(in1 context.Context, in2 string, in3 *certify.CertConfig) (*tls.Certificate, error) {
+				return &tls.Certificate{
+					Leaf: &x509.Certificate{
+						SerialNumber: big.NewInt(123456),
+						NotAfter:     time.Now().Add(time.Hour),
+					},
+				}, nil
+			},
+		}
+		l := &certify.LimitIssuer{
+			Issuer:    issuer,
+			RateLimit: rate.Every(time.Hour),
+			Burst:     2,
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err := l.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := l.Issue(ctx, "myserver.com", &certify.CertConfig{})
+		Expect(err).To(MatchError(certify.ErrIssueLimited))
+		Expect(issuer.IssueCalls()).To(HaveLen(2))
+	})
+})
+
+var _ = Describe("HostPolicy", func() {
+	policies := []struct {
+		Type    string
+		Policy  certify.HostPolicy
+		Allowed []string
+		Denied  []string
+	}{
+		{
+			Type:    "HostWhitelist",
+			Policy:  certify.HostWhitelist("example.com", "OTHER.example.com."),
+			Allowed: []string{"example.com", "other.example.com"},
+			Denied:  []string{"a.example.com", "example.org"},
+		},
+		{
+			Type:    "HostWildcards",
+			Policy:  certify.HostWildcards("*.svc.example.com", "example.com"),
+			Allowed: []string{"a.svc.example.com", "example.com"},
+			Denied:  []string{"svc.example.com", "a.b.svc.example.com", "a.example.com"},
+		},
+		{
+			Type:    "HostRegexp",
+			Policy:  certify.HostRegexp(regexp.MustCompile(`^[a-z]+\.example\.com$`)),
+			Allowed: []string{"abc.example.com"},
+			Denied:  []string{"a1.example.com", "example.com"},
+		},
+		{
+			Type:    "AnyHostPolicy",
+			Policy:  certify.AnyHostPolicy(certify.HostWhitelist("example.com"), certify.HostWildcards("*.example.org")),
+			Allowed: []string{"example.com", "a.example.org"},
+			Denied:  []string{"example.org", "a.example.com"},
+		},
+	}
+
+	for _, policy := range policies {
+		p := policy
+		Context("when using "+p.Type, func() {
+			It("allows matching hosts and denies others", func() {
+				for _, host := range p.Allowed {
+					Expect(p.Policy(context.Background(), host)).To(Succeed(), host)
+				}
+				for _, host := range p.Denied {
+					Expect(p.Policy(context.Background(), host)).NotTo(Succeed(), host)
+				}
+			})
+		})
+	}
 })
 
+type recordingMetrics struct {
+	mu        sync.Mutex
+	issues    []string
+	cacheOps  []string
+	collapsed int
+	expiry    map[string]time.Time
+}
+
+func (r *recordingMetrics) ObserveIssue(issuer string, _ time.Duration, _ error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.issues = append(r.issues, issuer)
+}
+
+func (r *recordingMetrics) ObserveCache(op, result string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheOps = append(r.cacheOps, op+"/"+result)
+}
+
+func (r *recordingMetrics) ObserveIssueCollapsed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collapsed++
+}
+
+func (r *recordingMetrics) SetCertExpiry(key string, notAfter time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expiry[key] = notAfter
+}
+
+func (r *recordingMetrics) DeleteCertExpiry(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.expiry, key)
+}
+
+type logEntry struct {
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (r *recordingLogger) log(msg string, fields []map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	merged := map[string]interface{}{}
+	for _, f := range fields {
+		for k, v := range f {
+			merged[k] = v
+		}
+	}
+	r.entries = append(r.entries, logEntry{msg: msg, fields: merged})
+}
+
+func (r *recordingLogger) Trace(msg string, fields ...map[string]interface{}) { r.log(msg, fields) }
+func (r *recordingLogger) Debug(msg string, fields ...map[string]interface{}) { r.log(msg, fields) }
+func (r *recordingLogger) Info(msg string, fields ...map[string]interface{})  { r.log(msg, fields) }
+func (r *recordingLogger) Warn(msg string, fields ...map[string]interface{})  { r.log(msg, fields) }
+func (r *recordingLogger) Error(msg string, fields ...map[string]interface{}) { r.log(msg, fields) }
+
+// entry returns the fields of the last entry logged with the message.
+func (r *recordingLogger) entry(msg string) map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if r.entries[i].msg == msg {
+			return r.entries[i].fields
+		}
+	}
+	Fail(fmt.Sprintf("No entry logged with message %q", msg))
+	return nil
+}
+
 type keyGeneratorFunc func() (crypto.PrivateKey, error)
 
 func (kgf keyGeneratorFunc) Generate() (crypto.PrivateKey, error) {
@@ -0,0 +1,62 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+// CopyingCache implements the Cache interface by wrapping another
+// Cache, storing and returning copies of certificates. Caches such as
+// the one created by NewMemCache return the certificate that was
+// stored, so modifying a certificate returned by Get, for example to
+// set its OCSPStaple, would affect every other user of the certificate,
+// including concurrent TLS handshakes. Certificates returned by a
+// CopyingCache can be modified without affecting the stored certificate.
+//
+// See copyCertificate for what is copied.
+//
+// Cache is required.
+type CopyingCache struct {
+	// Cache is the Cache to store copies of certificates in.
+	Cache Cache
+}
+
+// Get gets a copy of a certificate from the wrapped Cache.
+func (c *CopyingCache) Get(ctx context.Context, key string) (*tls.Certificate, error) {
+	cert, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return copyCertificate(cert), nil
+}
+
+// Put puts a copy of a certificate in the wrapped Cache.
+func (c *CopyingCache) Put(ctx context.Context, key string, cert *tls.Certificate) error {
+	return c.Cache.Put(ctx, key, copyCertificate(cert))
+}
+
+// Delete deletes a certificate from the wrapped Cache.
+func (c *CopyingCache) Delete(ctx context.Context, key string) error {
+	return c.Cache.Delete(ctx, key)
+}
+
+// copyCertificate returns a copy of the certificate, where the fields of
+// the certificate and of its Leaf, and the elements of its slices, can be
+// set without affecting the original. The DER encoded certificates, the
+// values of the Leaf fields and the private key are shared, since
+// neither certify nor the crypto/tls package modify them.
+func copyCertificate(cert *tls.Certificate) *tls.Certificate {
+	if cert == nil {
+		return nil
+	}
+	cp := *cert
+	cp.Certificate = append([][]byte(nil), cert.Certificate...)
+	cp.SupportedSignatureAlgorithms = append([]tls.SignatureScheme(nil), cert.SupportedSignatureAlgorithms...)
+	cp.OCSPStaple = append([]byte(nil), cert.OCSPStaple...)
+	cp.SignedCertificateTimestamps = append([][]byte(nil), cert.SignedCertificateTimestamps...)
+	if cert.Leaf != nil {
+		leaf := *cert.Leaf
+		cp.Leaf = &leaf
+	}
+	return &cp
+}
@@ -0,0 +1,72 @@
+package certify_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"math/big"
+	"net"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+var _ = Describe("CopyingCache", func() {
+	var cert *tls.Certificate
+
+	BeforeEach(func() {
+		var err error
+		cert, err = generateCertAndKey("localhost", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+	})
+
+	It("returns certificates that can be modified concurrently", func() {
+		cache := &certify.CopyingCache{Cache: certify.NewMemCache()}
+		Expect(cache.Put(context.Background(), "key", cert)).To(Succeed())
+		serial := new(big.Int).Set(cert.Leaf.SerialNumber)
+
+		// Modifying the stored certificate doesn't affect the cache
+		cert.OCSPStaple = []byte("staple")
+		cert.Certificate[0] = nil
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				got, err := cache.Get(context.Background(), "key")
+				Expect(err).To(Succeed())
+				Expect(got.OCSPStaple).To(BeEmpty())
+				Expect(got.Certificate[0]).NotTo(BeEmpty())
+				Expect(got.Leaf.SerialNumber).To(Equal(serial))
+
+				got.OCSPStaple = []byte{byte(i)}
+				got.Certificate = append(got.Certificate, []byte{byte(i)})
+				got.Certificate[0] = nil
+				got.Leaf.SerialNumber = big.NewInt(int64(i))
+			}(i)
+		}
+		wg.Wait()
+
+		got, err := cache.Get(context.Background(), "key")
+		Expect(err).To(Succeed())
+		Expect(got.OCSPStaple).To(BeEmpty())
+		Expect(got.Certificate).To(HaveLen(1))
+		Expect(got.Leaf.SerialNumber).To(Equal(serial))
+	})
+
+	It("returns errors of the wrapped cache", func() {
+		cache := &certify.CopyingCache{Cache: certify.NewMemCache()}
+		_, err := cache.Get(context.Background(), "key")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+	})
+})
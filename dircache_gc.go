@@ -0,0 +1,228 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultGCGracePeriod = time.Hour
+
+// GCReason describes why a file was garbage collected.
+type GCReason string
+
+// Reasons for garbage collecting files.
+const (
+	// GCExpired is used for certificates that have expired,
+	// and their keys.
+	GCExpired GCReason = "expired"
+	// GCTemporary is used for temporary files left
+	// behind by interrupted writes.
+	GCTemporary GCReason = "temporary"
+	// GCMismatched is used for bundles, certificates and
+	// keys that can't be parsed or don't match each other.
+	GCMismatched GCReason = "mismatched"
+	// GCIncomplete is used for certificates without a key,
+	// and keys without a certificate.
+	GCIncomplete GCReason = "incomplete"
+)
+
+// GCOptions configures DirCache.GC.
+type GCOptions struct {
+	// DryRun lists the files that would be removed
+	// without removing them.
+	DryRun bool
+
+	// GracePeriod is how long after they were last modified
+	// temporary files, and mismatched or incomplete pairs, are
+	// left alone, to avoid interfering with concurrent writes.
+	// Expired certificates are removed regardless.
+	// Defaults to 1 hour.
+	GracePeriod time.Duration
+}
+
+// GCFile describes a file garbage collected by DirCache.GC.
+type GCFile struct {
+	// Path is the path of the file.
+	Path string
+	// Reason is the reason the file was garbage collected.
+	Reason GCReason
+}
+
+// GC removes expired certificates, temporary files left behind by
+// interrupted writes and certificates and keys that can't be used,
+// from the cache directory. It returns the files removed, or, if
+// DryRun is set, the files that would have been removed.
+// If removing a file fails, GC carries on and returns the last error
+// alongside the files that were removed.
+//
+// GC is safe to call concurrently with other operations on the
+// cache, and can be called periodically to keep the directory tidy.
+func (d DirCache) GC(ctx context.Context, opts GCOptions) ([]GCFile, error) {
+	grace := opts.GracePeriod
+	if grace <= 0 {
+		grace = defaultGCGracePeriod
+	}
+
+	infos, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	modified := map[string]time.Time{}
+	names := map[string]bool{}
+	var (
+		bundles    []string
+		candidates []GCFile
+	)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		fileName := info.Name()
+		path := filepath.Join(string(d), fileName)
+		modified[fileName] = info.ModTime()
+		switch ext := filepath.Ext(fileName); {
+		case ext == bundleExt:
+			bundles = append(bundles, strings.TrimSuffix(fileName, ext))
+		case ext == keyExt || ext == certExt:
+			names[strings.TrimSuffix(fileName, ext)] = true
+		case isTempFile(fileName):
+			if now.Sub(info.ModTime()) > grace {
+				candidates = append(candidates, GCFile{Path: path, Reason: GCTemporary})
+			}
+		}
+	}
+
+	for _, name := range bundles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reason, ok := d.checkBundle(name, now)
+		if !ok {
+			continue
+		}
+		if reason != GCExpired && now.Sub(modified[name+bundleExt]) <= grace {
+			continue
+		}
+		candidates = append(candidates, GCFile{Path: filepath.Join(string(d), name+bundleExt), Reason: reason})
+	}
+
+	// Key and certificate pairs written by earlier versions of DirCache
+	for name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keyMod, hasKey := modified[name+keyExt]
+		certMod, hasCert := modified[name+certExt]
+		reason, ok := d.checkPair(name, hasKey, hasCert, now)
+		if !ok {
+			continue
+		}
+		if reason != GCExpired && (now.Sub(keyMod) <= grace || now.Sub(certMod) <= grace) {
+			// Could be a concurrent write, check again later
+			continue
+		}
+		path := filepath.Join(string(d), name)
+		if hasCert {
+			candidates = append(candidates, GCFile{Path: path + certExt, Reason: reason})
+		}
+		if hasKey {
+			candidates = append(candidates, GCFile{Path: path + keyExt, Reason: reason})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Path < candidates[j].Path
+	})
+	if opts.DryRun {
+		return candidates, nil
+	}
+
+	removed := make([]GCFile, 0, len(candidates))
+	for _, f := range candidates {
+		if e := os.Remove(f.Path); e != nil && !os.IsNotExist(e) {
+			err = fmt.Errorf("failed to delete %s: %v", f.Path, e)
+			continue
+		}
+		removed = append(removed, f)
+	}
+
+	return removed, err
+}
+
+// checkBundle reports whether the bundle stored under
+// name should be garbage collected, and the reason.
+func (d DirCache) checkBundle(name string, now time.Time) (GCReason, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(string(d), name+bundleExt))
+	if err != nil {
+		// Deleted concurrently, or unreadable
+		return "", false
+	}
+	cert, err := DecodeBundle(data)
+	if err != nil {
+		return GCMismatched, true
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return GCExpired, true
+	}
+	return "", false
+}
+
+// checkPair reports whether the certificate and key stored under
+// name should be garbage collected, and the reason.
+func (d DirCache) checkPair(name string, hasKey, hasCert bool, now time.Time) (GCReason, bool) {
+	if !hasKey || !hasCert {
+		return GCIncomplete, true
+	}
+	path := filepath.Join(string(d), name)
+	cert, err := tls.LoadX509KeyPair(path+certExt, path+keyExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted concurrently
+			return "", false
+		}
+		return GCMismatched, true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return GCMismatched, true
+	}
+	if now.After(leaf.NotAfter) {
+		return GCExpired, true
+	}
+	return "", false
+}
+
+// isTempFile reports whether the file name is that of a
+// temporary file created by DirCache.Put, which have a prefix
+// and a random number appended to the extension. Earlier
+// versions of DirCache didn't use the prefix.
+func isTempFile(fileName string) bool {
+	if strings.HasPrefix(fileName, tmpPrefix) {
+		return true
+	}
+	i := -1
+	for _, ext := range []string{bundleExt, keyExt, certExt} {
+		if j := strings.LastIndex(fileName, ext); j > i {
+			i = j
+		}
+	}
+	if i < 0 {
+		return false
+	}
+	// All extensions are the same length
+	suffix := fileName[i+len(bundleExt):]
+	return suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
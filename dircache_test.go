@@ -0,0 +1,327 @@
+package certify_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+var _ = Describe("DirCache", func() {
+	var (
+		dir   string
+		cache certify.DirCache
+		cert  *tls.Certificate
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).To(Succeed())
+		cache = certify.DirCache(dir)
+		cert, err = generateCertAndKey("localhost", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("stores the certificate in a single bundle file", func() {
+		Expect(cache.Put(context.Background(), "localhost", cert)).To(Succeed())
+
+		infos, err := ioutil.ReadDir(dir)
+		Expect(err).To(Succeed())
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Name()).To(Equal("localhost.pem"))
+		Expect(infos[0].Mode().Perm()).To(Equal(os.FileMode(0o600)))
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "localhost.pem"))
+		Expect(err).To(Succeed())
+		decoded, err := certify.DecodeBundle(data)
+		Expect(err).To(Succeed())
+		Expect(decoded).To(BeEquivalentTo(cert))
+
+		// Usable as a combined key and certificate file
+		_, err = tls.LoadX509KeyPair(filepath.Join(dir, "localhost.pem"), filepath.Join(dir, "localhost.pem"))
+		Expect(err).To(Succeed())
+	})
+
+	It("reports a bundle with a mismatched key as a cache miss", func() {
+		other, err := generateCertAndKey("other", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+		data, err := certify.EncodeBundle(&tls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  other.PrivateKey,
+		})
+		Expect(err).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "localhost.pem"), data, 0o600)).To(Succeed())
+
+		_, err = cache.Get(context.Background(), "localhost")
+		Expect(errors.Is(err, certify.ErrCacheMiss)).To(BeTrue(), "got %v", err)
+	})
+
+	It("reads and replaces certificates written by earlier versions", func() {
+		writeKeyPair(dir, "localhost", cert.Certificate[0], cert.PrivateKey)
+
+		cached, err := cache.Get(context.Background(), "localhost")
+		Expect(err).To(Succeed())
+		Expect(cached.Leaf.SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+
+		Expect(cache.Put(context.Background(), "localhost", cert)).To(Succeed())
+		Expect(filepath.Join(dir, "localhost.crt")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dir, "localhost.key")).NotTo(BeAnExistingFile())
+		_, err = cache.Get(context.Background(), "localhost")
+		Expect(err).To(Succeed())
+
+		Expect(cache.Delete(context.Background(), "localhost")).To(Succeed())
+		infos, err := ioutil.ReadDir(dir)
+		Expect(err).To(Succeed())
+		Expect(infos).To(BeEmpty())
+	})
+
+	It("lists bundles and certificates written by earlier versions", func() {
+		Expect(cache.Put(context.Background(), "bundle", cert)).To(Succeed())
+		writeKeyPair(dir, "legacy", cert.Certificate[0], cert.PrivateKey)
+		// Unusable and temporary files are skipped
+		Expect(ioutil.WriteFile(filepath.Join(dir, "corrupt.pem"), []byte("not a bundle"), 0o600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "incomplete.crt"), []byte("not a cert"), 0o600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "bundle.pem123"), []byte("partial"), 0o600)).To(Succeed())
+
+		entries, err := cache.List(context.Background())
+		Expect(err).To(Succeed())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Name).To(Equal("bundle"))
+		Expect(entries[1].Name).To(Equal("legacy"))
+		Expect(entries[1].SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+
+		Expect(certify.DirCache(filepath.Join(dir, "missing")).List(context.Background())).To(BeEmpty())
+	})
+
+	It("doesn't leave temporary files behind when writing fails", func() {
+		err := cache.Put(context.Background(), "localhost", &tls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  "not a key",
+		})
+		Expect(err).To(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(cache.Put(ctx, "localhost", cert)).NotTo(Succeed())
+		Eventually(func() ([]os.FileInfo, error) {
+			return ioutil.ReadDir(dir)
+		}).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("DirCache GC", func() {
+	var (
+		dir   string
+		cache certify.DirCache
+		old   time.Time
+	)
+	ecdsaKey := keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	})
+	put := func(name string, cert *tls.Certificate) {
+		Expect(cache.Put(context.Background(), name, cert)).To(Succeed())
+	}
+	age := func(fileNames ...string) {
+		for _, fileName := range fileNames {
+			Expect(os.Chtimes(filepath.Join(dir, fileName), old, old)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).To(Succeed())
+		cache = certify.DirCache(dir)
+		old = time.Now().Add(-2 * time.Hour)
+
+		valid, err := generateCertAndKey("valid.com", net.IPv4(127, 0, 0, 1), ecdsaKey)
+		Expect(err).To(Succeed())
+		put("valid.com", valid)
+
+		expired, err := generateExpiredCert()
+		Expect(err).To(Succeed())
+		put("expired.com", expired)
+
+		other, err := generateCertAndKey("other.com", net.IPv4(127, 0, 0, 1), ecdsaKey)
+		Expect(err).To(Succeed())
+		mismatched, err := certify.EncodeBundle(&tls.Certificate{
+			Certificate: valid.Certificate,
+			PrivateKey:  other.PrivateKey,
+		})
+		Expect(err).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "mismatched.com.pem"), mismatched, 0o600)).To(Succeed())
+
+		// Pairs written by earlier versions of DirCache
+		writeKeyPair(dir, "legacy-expired.com", expired.Certificate[0], expired.PrivateKey)
+		writeKeyPair(dir, "legacy-mismatched.com", valid.Certificate[0], other.PrivateKey)
+		writeKeyPair(dir, "legacy-incomplete.com", nil, other.PrivateKey)
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "stale.com.pem123456"), []byte("bundle"), 0o600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "recent.com.crt654321"), []byte("cert"), 0o600)).To(Succeed())
+		age(
+			"valid.com.pem",
+			"mismatched.com.pem",
+			"legacy-mismatched.com.crt",
+			"legacy-mismatched.com.key",
+			"legacy-incomplete.com.key",
+			"stale.com.pem123456",
+		)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	want := func() []certify.GCFile {
+		return []certify.GCFile{
+			{Path: filepath.Join(dir, "expired.com.pem"), Reason: certify.GCExpired},
+			{Path: filepath.Join(dir, "legacy-expired.com.crt"), Reason: certify.GCExpired},
+			{Path: filepath.Join(dir, "legacy-expired.com.key"), Reason: certify.GCExpired},
+			{Path: filepath.Join(dir, "legacy-incomplete.com.key"), Reason: certify.GCIncomplete},
+			{Path: filepath.Join(dir, "legacy-mismatched.com.crt"), Reason: certify.GCMismatched},
+			{Path: filepath.Join(dir, "legacy-mismatched.com.key"), Reason: certify.GCMismatched},
+			{Path: filepath.Join(dir, "mismatched.com.pem"), Reason: certify.GCMismatched},
+			{Path: filepath.Join(dir, "stale.com.pem123456"), Reason: certify.GCTemporary},
+		}
+	}
+
+	It("removes expired, mismatched, incomplete and temporary files", func() {
+		removed, err := cache.GC(context.Background(), certify.GCOptions{})
+		Expect(err).To(Succeed())
+		Expect(removed).To(Equal(want()))
+
+		infos, err := ioutil.ReadDir(dir)
+		Expect(err).To(Succeed())
+		var remaining []string
+		for _, info := range infos {
+			remaining = append(remaining, info.Name())
+		}
+		Expect(remaining).To(ConsistOf("recent.com.crt654321", "valid.com.pem"))
+
+		_, err = cache.Get(context.Background(), "valid.com")
+		Expect(err).To(Succeed())
+	})
+
+	It("leaves recently modified files alone", func() {
+		age("recent.com.crt654321")
+		Expect(os.Chtimes(filepath.Join(dir, "mismatched.com.pem"), time.Now(), time.Now())).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(dir, "legacy-mismatched.com.key"), time.Now(), time.Now())).To(Succeed())
+
+		removed, err := cache.GC(context.Background(), certify.GCOptions{DryRun: true})
+		Expect(err).To(Succeed())
+		Expect(removed).To(ConsistOf(
+			certify.GCFile{Path: filepath.Join(dir, "expired.com.pem"), Reason: certify.GCExpired},
+			certify.GCFile{Path: filepath.Join(dir, "legacy-expired.com.crt"), Reason: certify.GCExpired},
+			certify.GCFile{Path: filepath.Join(dir, "legacy-expired.com.key"), Reason: certify.GCExpired},
+			certify.GCFile{Path: filepath.Join(dir, "legacy-incomplete.com.key"), Reason: certify.GCIncomplete},
+			certify.GCFile{Path: filepath.Join(dir, "recent.com.crt654321"), Reason: certify.GCTemporary},
+			certify.GCFile{Path: filepath.Join(dir, "stale.com.pem123456"), Reason: certify.GCTemporary},
+		))
+	})
+
+	It("removes temporary files of wildcard certificates", func() {
+		wildcard, err := generateCertAndKey("*.svc.example.com", net.IPv4(127, 0, 0, 1), ecdsaKey)
+		Expect(err).To(Succeed())
+		put("*.svc.example.com", wildcard)
+		age("*.svc.example.com.pem")
+		// Left behind by an interrupted Put of the wildcard certificate
+		tmp, err := ioutil.TempFile(dir, ".tmp-_.svc.example.com.pem.*")
+		Expect(err).To(Succeed())
+		_, err = tmp.Write([]byte("bundle"))
+		Expect(err).To(Succeed())
+		Expect(tmp.Close()).To(Succeed())
+		age(filepath.Base(tmp.Name()))
+
+		entries, err := cache.List(context.Background())
+		Expect(err).To(Succeed())
+		var listed []string
+		for _, e := range entries {
+			listed = append(listed, e.Name)
+		}
+		Expect(listed).To(Equal([]string{"*.svc.example.com", "expired.com", "legacy-expired.com", "valid.com"}))
+
+		removed, err := cache.GC(context.Background(), certify.GCOptions{})
+		Expect(err).To(Succeed())
+		Expect(removed).To(ContainElement(certify.GCFile{Path: tmp.Name(), Reason: certify.GCTemporary}))
+		Expect(tmp.Name()).NotTo(BeAnExistingFile())
+
+		got, err := cache.Get(context.Background(), "*.svc.example.com")
+		Expect(err).To(Succeed())
+		Expect(got.Leaf.SerialNumber).To(Equal(wildcard.Leaf.SerialNumber))
+	})
+
+	Context("in dry run mode", func() {
+		It("lists the files without removing them", func() {
+			listed, err := cache.GC(context.Background(), certify.GCOptions{DryRun: true})
+			Expect(err).To(Succeed())
+			Expect(listed).To(Equal(want()))
+
+			for _, f := range listed {
+				Expect(f.Path).To(BeAnExistingFile())
+			}
+		})
+	})
+})
+
+// writeKeyPair writes a certificate and key in the
+// format used by earlier versions of DirCache.
+func writeKeyPair(dir, name string, der []byte, key crypto.PrivateKey) {
+	if der != nil {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		Expect(ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600)).To(Succeed())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	Expect(err).To(Succeed())
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600)).To(Succeed())
+}
+
+func generateExpiredCert() (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,308 @@
+package certify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/johanbrandhorst/certify/internal/keys"
+)
+
+// ErrUnknownKey should be returned by KeyProvider implementations
+// when a key with the requested ID doesn't exist, for example because
+// it has been retired. EncryptedCache treats entries encrypted with
+// unknown keys as cache misses.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyProvider provides the keys used by EncryptedCache
+// to encrypt and decrypt private keys. Keys must be 16, 24
+// or 32 bytes long, to select AES-128, AES-192 or AES-256.
+// KeyProvider implementations must be thread safe.
+type KeyProvider interface {
+	// CurrentKey returns the key new entries are
+	// encrypted with, and its ID.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the key with the ID, to decrypt entries.
+	// If there is no such key, Key returns ErrUnknownKey.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// Keyring implements the KeyProvider interface with a
+// current key, used to encrypt new entries, and any number
+// of previous keys, used to decrypt entries encrypted before
+// the current key was introduced. The ID of each key is
+// derived from the key itself.
+type Keyring struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewKeyring creates a Keyring from a current key and any
+// previous keys. Keys must be 16, 24 or 32 bytes long.
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{
+		keys: map[string][]byte{},
+	}
+	for i, key := range append([][]byte{current}, previous...) {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %d: %w", i, err)
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		if i == 0 {
+			k.currentID = id
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+// KeyringFromEnv creates a Keyring from the comma separated,
+// base64 encoded keys in the environment variable. The first key
+// is the current key, any others are previous keys.
+func KeyringFromEnv(name string) (*Keyring, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+	return parseKeyring(strings.Split(value, ","))
+}
+
+// KeyringFromFile creates a Keyring from the base64 encoded
+// keys in the file, one per line. The first key is the current
+// key, any others are previous keys.
+func KeyringFromFile(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyring(strings.Split(string(data), "\n"))
+}
+
+func parseKeyring(encoded []string) (*Keyring, error) {
+	var decoded [][]byte
+	for _, e := range encoded {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %d: %w", len(decoded), err)
+		}
+		decoded = append(decoded, key)
+	}
+	if len(decoded) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return NewKeyring(decoded[0], decoded[1:]...)
+}
+
+// CurrentKey returns the current key and its ID.
+func (k *Keyring) CurrentKey(context.Context) (string, []byte, error) {
+	return k.currentID, k.keys[k.currentID], nil
+}
+
+// Key returns the key with the ID.
+func (k *Keyring) Key(_ context.Context, id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// SealedKey is a private key encrypted by EncryptedCache.
+// It is stored in the wrapped Cache in place of the private key
+// of the certificate. EncodeBundle and DecodeBundle support
+// SealedKey, so it can be stored by caches using them.
+type SealedKey struct {
+	// KeyID is the ID of the key the private key was encrypted with.
+	KeyID string
+	// Ciphertext is the nonce followed by the AES-GCM
+	// encrypted private key in PEM format.
+	Ciphertext []byte
+}
+
+// EncryptedCache implements the Cache interface by wrapping another
+// Cache, encrypting the private keys of certificates with AES-GCM
+// before they are stored. The wrapped Cache must store the private
+// key as a *SealedKey, either in memory, or by using EncodeBundle,
+// as DirCache and the Redis and Vault caches do. Caches storing
+// the private key in PEM format, such as the SQL and Kubernetes
+// caches, can't be wrapped. The name of each entry is authenticated,
+// so entries can't be swapped between names.
+//
+// Entries stored before encryption was enabled are returned as
+// they are, and are encrypted when they are next stored. Use
+// Rotate to re-encrypt entries with the current key.
+//
+// Cache and Keys are required.
+type EncryptedCache struct {
+	// Cache is the Cache to store encrypted entries in.
+	Cache Cache
+
+	// Keys provides the keys to encrypt and decrypt
+	// entries with. See Keyring for an implementation.
+	Keys KeyProvider
+}
+
+// Get gets a certificate from the wrapped Cache and
+// decrypts its private key. If the private key can't be
+// decrypted, was encrypted with an unknown key or doesn't
+// match the certificate, a wrapped ErrCacheMiss is returned.
+func (e *EncryptedCache) Get(ctx context.Context, name string) (*tls.Certificate, error) {
+	cert, err := e.Cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return e.decrypt(ctx, name, cert)
+}
+
+// decrypt decrypts the private key of a certificate from the wrapped Cache.
+func (e *EncryptedCache) decrypt(ctx context.Context, name string, cert *tls.Certificate) (*tls.Certificate, error) {
+	sealed, ok := cert.PrivateKey.(*SealedKey)
+	if !ok {
+		// Stored before encryption was enabled
+		return cert, nil
+	}
+
+	key, err := e.Keys.Key(ctx, sealed.KeyID)
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, fmt.Errorf("%w: %v", ErrCacheMiss, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := openKey(key, sealed.Ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt private key of %s: %v", ErrCacheMiss, name, err)
+	}
+
+	// X509KeyPair validates that the key matches the certificate
+	var certPEM bytes.Buffer
+	for _, c := range cert.Certificate {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: c}); err != nil {
+			return nil, err
+		}
+	}
+	pair, err := tls.X509KeyPair(certPEM.Bytes(), keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid private key of %s: %v", ErrCacheMiss, name, err)
+	}
+
+	decrypted := *cert
+	decrypted.PrivateKey = pair.PrivateKey
+	return &decrypted, nil
+}
+
+// Put encrypts the private key of the certificate with
+// the current key and stores it in the wrapped Cache.
+func (e *EncryptedCache) Put(ctx context.Context, name string, cert *tls.Certificate) error {
+	id, key, err := e.Keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := keys.Marshal(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := sealKey(key, keyPEM, []byte(name))
+	if err != nil {
+		return err
+	}
+
+	encrypted := *cert
+	encrypted.PrivateKey = &SealedKey{
+		KeyID:      id,
+		Ciphertext: ciphertext,
+	}
+	return e.Cache.Put(ctx, name, &encrypted)
+}
+
+// Delete deletes a certificate from the wrapped Cache.
+func (e *EncryptedCache) Delete(ctx context.Context, name string) error {
+	return e.Cache.Delete(ctx, name)
+}
+
+// Rotate re-encrypts the entries with the names using the
+// current key. It can be used to re-encrypt existing entries
+// after a new key has been introduced, after which the previous
+// key can be retired. Names not found in the cache are skipped.
+// Rotate carries on if an entry fails, and returns the last error.
+func (e *EncryptedCache) Rotate(ctx context.Context, names ...string) error {
+	currentID, _, err := e.Keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, name := range names {
+		raw, err := e.Cache.Get(ctx, name)
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("failed to rotate %s: %w", name, err)
+			continue
+		}
+		if sealed, ok := raw.PrivateKey.(*SealedKey); ok && sealed.KeyID == currentID {
+			continue
+		}
+		cert, err := e.decrypt(ctx, name, raw)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to rotate %s: %w", name, err)
+			continue
+		}
+		if err := e.Put(ctx, name, cert); err != nil {
+			lastErr = fmt.Errorf("failed to rotate %s: %w", name, err)
+		}
+	}
+
+	return lastErr
+}
+
+func sealKey(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openKey(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
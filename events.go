@@ -0,0 +1,184 @@
+package certify
+
+import (
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPendingEvents is the number of handler calls that can be
+// queued before further events are dropped.
+const maxPendingEvents = 1024
+
+// events holds the event handlers registered on Certify
+// and the queue of pending calls to them.
+type events struct {
+	mu           sync.Mutex
+	issued       []func(string, *x509.Certificate)
+	renewed      []func(string, *x509.Certificate)
+	expiringSoon []func(string, *x509.Certificate)
+	errors       []func(string, error)
+
+	// pending calls are made in order by a single goroutine,
+	// which runs while there are calls in the queue.
+	pending []func()
+	running bool
+	dropped uint64
+
+	// expiring holds the serial number of the certificate
+	// OnExpiringSoon was last emitted for, by name, so it's
+	// emitted once per certificate rather than per handshake
+	// while it's being renewed.
+	expiring map[string]string
+}
+
+// OnIssued registers a function to be called when a certificate
+// is issued for a name that had no certificate in the cache.
+// The name is the key the certificate is cached under.
+//
+// Handlers are called asynchronously, one at a time, in the order
+// the events occurred and the handlers were registered.
+func (c *Certify) OnIssued(fn func(name string, cert *x509.Certificate)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	c.events.issued = append(c.events.issued, fn)
+}
+
+// OnRenewed registers a function to be called when a certificate
+// is issued to replace a cached certificate that was within
+// the RenewBefore threshold of its expiry, or that did not
+// cover all names in a Batch.
+// The name is the key the certificate is cached under.
+//
+// Handlers are called asynchronously, one at a time, in the order
+// the events occurred and the handlers were registered.
+func (c *Certify) OnRenewed(fn func(name string, cert *x509.Certificate)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	c.events.renewed = append(c.events.renewed, fn)
+}
+
+// OnExpiringSoon registers a function to be called when a cached
+// certificate is found to be within the RenewBefore threshold of its
+// expiry, just before it is evicted from the cache and renewed.
+// It's called once per certificate, even if it's found again
+// while it's being renewed.
+// The name is the key the certificate is cached under.
+//
+// Handlers are called asynchronously, one at a time, in the order
+// the events occurred and the handlers were registered.
+func (c *Certify) OnExpiringSoon(fn func(name string, cert *x509.Certificate)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	c.events.expiringSoon = append(c.events.expiringSoon, fn)
+}
+
+// OnError registers a function to be called when issuing
+// or caching a certificate fails.
+// The name is the key the certificate is cached under.
+//
+// Handlers are called asynchronously, one at a time, in the order
+// the events occurred and the handlers were registered.
+func (c *Certify) OnError(fn func(name string, err error)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	c.events.errors = append(c.events.errors, fn)
+}
+
+// DroppedEvents returns the number of events that weren't passed
+// to handlers because too many calls to them were pending.
+func (c *Certify) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&c.events.dropped)
+}
+
+// enqueue schedules calls to handlers, starting
+// a goroutine to make them if one isn't running.
+// The calls are dropped if the queue is full.
+func (e *events) enqueue(calls ...func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending)+len(calls) > maxPendingEvents {
+		atomic.AddUint64(&e.dropped, 1)
+		return
+	}
+	e.pending = append(e.pending, calls...)
+	if e.running {
+		return
+	}
+	e.running = true
+	go e.run()
+}
+
+func (e *events) run() {
+	for {
+		e.mu.Lock()
+		if len(e.pending) == 0 {
+			e.running = false
+			e.mu.Unlock()
+			return
+		}
+		call := e.pending[0]
+		e.pending = e.pending[1:]
+		e.mu.Unlock()
+		call()
+	}
+}
+
+func (e *events) emitCert(handlers *[]func(string, *x509.Certificate), name string, cert *x509.Certificate) {
+	e.mu.Lock()
+	hs := *handlers
+	e.mu.Unlock()
+	var calls []func()
+	for _, h := range hs {
+		h := h
+		calls = append(calls, func() { h(name, cert) })
+	}
+	if len(calls) > 0 {
+		e.enqueue(calls...)
+	}
+}
+
+func (e *events) issuedCert(name string, cert *x509.Certificate) {
+	e.clearExpiring(name)
+	e.emitCert(&e.issued, name, cert)
+}
+
+func (e *events) renewedCert(name string, cert *x509.Certificate) {
+	e.clearExpiring(name)
+	e.emitCert(&e.renewed, name, cert)
+}
+
+func (e *events) certExpiringSoon(name string, cert *x509.Certificate) {
+	serial := cert.SerialNumber.String()
+	e.mu.Lock()
+	if e.expiring[name] == serial {
+		e.mu.Unlock()
+		return
+	}
+	if e.expiring == nil {
+		e.expiring = make(map[string]string)
+	}
+	e.expiring[name] = serial
+	e.mu.Unlock()
+	e.emitCert(&e.expiringSoon, name, cert)
+}
+
+func (e *events) clearExpiring(name string) {
+	e.mu.Lock()
+	delete(e.expiring, name)
+	e.mu.Unlock()
+}
+
+func (e *events) error(name string, err error) {
+	e.mu.Lock()
+	hs := e.errors
+	e.mu.Unlock()
+	var calls []func()
+	for _, h := range hs {
+		h := h
+		calls = append(calls, func() { h(name, err) })
+	}
+	if len(calls) > 0 {
+		e.enqueue(calls...)
+	}
+}
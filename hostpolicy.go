@@ -0,0 +1,102 @@
+package certify
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// HostPolicy specifies which host names Certify is allowed to
+// request certificates for. It is called by GetCertificate with
+// the normalized server name before the cache or issuer is consulted.
+// Returning a non-nil error rejects the handshake.
+//
+// The context is the context of the TLS handshake.
+type HostPolicy func(ctx context.Context, host string) error
+
+// HostWhitelist returns a HostPolicy that only allows
+// the exact host names provided. Matching is case insensitive
+// and ignores any trailing dot.
+func HostWhitelist(hosts ...string) HostPolicy {
+	allowed := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		allowed[normalizeHost(h)] = struct{}{}
+	}
+	return func(_ context.Context, host string) error {
+		if _, ok := allowed[host]; !ok {
+			return fmt.Errorf("host %q not configured in HostWhitelist", host)
+		}
+		return nil
+	}
+}
+
+// HostWildcards returns a HostPolicy that allows any host
+// name matching one of the provided wildcard patterns.
+// A pattern of the form "*.example.com" matches exactly one
+// label in place of the asterisk, so "a.example.com" is allowed
+// but "example.com" and "a.b.example.com" are not. Patterns
+// without a wildcard must match exactly.
+func HostWildcards(patterns ...string) HostPolicy {
+	normalized := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		normalized = append(normalized, normalizeHost(p))
+	}
+	return func(_ context.Context, host string) error {
+		for _, p := range normalized {
+			if matchWildcard(p, host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host %q does not match any allowed wildcard", host)
+	}
+}
+
+// HostRegexp returns a HostPolicy that allows any host name
+// matching at least one of the provided regular expressions.
+// The expressions are matched against the normalized, lower case
+// host name and should be anchored by the caller if partial matches
+// are not desired.
+func HostRegexp(exprs ...*regexp.Regexp) HostPolicy {
+	return func(_ context.Context, host string) error {
+		for _, re := range exprs {
+			if re.MatchString(host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host %q does not match any allowed expression", host)
+	}
+}
+
+// AnyHostPolicy returns a HostPolicy that allows a host name
+// if at least one of the provided policies allows it.
+// If all policies reject the host name, the error of the
+// last policy is returned.
+func AnyHostPolicy(policies ...HostPolicy) HostPolicy {
+	return func(ctx context.Context, host string) error {
+		err := fmt.Errorf("host %q not allowed", host)
+		for _, p := range policies {
+			if err = p(ctx, host); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// matchWildcard reports whether host matches pattern,
+// where a leading "*." in pattern matches exactly one label.
+func matchWildcard(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	i := strings.IndexByte(host, '.')
+	if i <= 0 {
+		return false
+	}
+	return host[i:] == pattern[1:]
+}
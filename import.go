@@ -0,0 +1,137 @@
+package certify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Import validates an existing certificate and private key, and stores
+// them in the cache under the name, so that Certify serves the certificate
+// until it is due for renewal. It can be used to migrate services with
+// existing certificates to Certify without issuing new certificates.
+//
+// The name is the name Certify looks the certificate up with: the server
+// name, the CommonName for client certificates, or the wildcard name if
+// Wildcards are configured. Like server names, it's lowercased and any
+// trailing dot and port are removed. Imported certificates are not used
+// if Variants are configured, as each variant is cached under the name
+// followed by "+" and the name of the variant.
+//
+// certPEM holds the PEM encoded certificate, followed by its chain, and
+// keyPEM the PEM encoded private key. Import returns an error if the
+// private key doesn't match the certificate, or if the certificate
+// isn't currently valid.
+func Import(ctx context.Context, cache Cache, name string, certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate and private key: %w", err)
+	}
+	return importCert(ctx, cache, name, &cert)
+}
+
+// ImportPKCS12 is like Import, but reads the certificate, its chain and
+// private key from a PKCS#12 (.p12 or .pfx) file, decrypted with the
+// password. The file must hold a single private key. The certificate
+// matching the private key and the certificates of its chain are
+// imported, and any other certificates in the file are ignored.
+// Files encrypted with AES, the default of OpenSSL 3, and with
+// the legacy algorithms based on 3DES and RC2 are supported.
+func ImportPKCS12(ctx context.Context, cache Cache, name string, data []byte, password string) error {
+	cert, err := decodePKCS12(data, password)
+	if err != nil {
+		return fmt.Errorf("invalid PKCS#12 file: %w", err)
+	}
+	return importCert(ctx, cache, name, cert)
+}
+
+// importCert validates the certificate and stores it in the cache.
+func importCert(ctx context.Context, cache Cache, name string, cert *tls.Certificate) error {
+	// Normalize the name like server names requested by
+	// clients, so that GetCertificate finds the certificate.
+	name, err := serverName(name)
+	if err != nil {
+		return fmt.Errorf("invalid name to import certificate as: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	return cache.Put(ctx, name, cert)
+}
+
+// decodePKCS12 decodes the private key in the PKCS#12 data,
+// with the certificate matching it and its chain.
+func decodePKCS12(data []byte, password string) (*tls.Certificate, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDER,
+	})
+
+	// The certificates may be in any order, so look
+	// for the one matching the private key.
+	certs := append([]*x509.Certificate{cert}, caCerts...)
+	for _, leaf := range certs {
+		var certPEM []byte
+		for _, c := range chainOf(leaf, certs) {
+			certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: c.Raw,
+			})...)
+		}
+		var cert tls.Certificate
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		if err == nil {
+			return &cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate matches the private key: %w", err)
+}
+
+// chainOf returns the leaf certificate, followed by the
+// certificates of its chain found among the certificates.
+func chainOf(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{leaf}
+	for cur := leaf; !bytes.Equal(cur.RawIssuer, cur.RawSubject); {
+		var issuer *x509.Certificate
+		for _, c := range certs {
+			if c == cur || !bytes.Equal(cur.RawIssuer, c.RawSubject) {
+				continue
+			}
+			if cur.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil || len(chain) >= len(certs) {
+			break
+		}
+		chain = append(chain, issuer)
+		cur = issuer
+	}
+	return chain
+}
@@ -0,0 +1,198 @@
+package certify_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/mocks"
+)
+
+// encodeKeyPair PEM encodes the chain and private key of the certificate.
+func encodeKeyPair(cert *tls.Certificate) (certPEM, keyPEM []byte) {
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	Expect(err).To(Succeed())
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+var _ = Describe("Import", func() {
+	var cert *tls.Certificate
+
+	BeforeEach(func() {
+		var err error
+		cert, err = generateCertAndKey("myserver.com", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+	})
+
+	It("stores the certificate in the cache", func() {
+		cache := certify.NewMemCache()
+		certPEM, keyPEM := encodeKeyPair(cert)
+		Expect(certify.Import(context.Background(), cache, "myserver.com", certPEM, keyPEM)).To(Succeed())
+
+		got, err := cache.Get(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+		Expect(got.Certificate).To(Equal(cert.Certificate))
+		Expect(got.PrivateKey).To(Equal(cert.PrivateKey))
+		Expect(got.Leaf).NotTo(BeNil())
+		Expect(got.Leaf.SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+	})
+
+	It("serves the imported certificate until it is due for renewal", func() {
+		issuer := &mocks.IssuerMock{
+			IssueFunc: func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+				return generateCertAndKey("myserver.com", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+					return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				})
+			},
+		}
+		cli := &certify.Certify{
+			CommonName: "myserver.com",
+			Issuer:     issuer,
+			Cache:      certify.NewMemCache(),
+		}
+		certPEM, keyPEM := encodeKeyPair(cert)
+		Expect(certify.Import(context.Background(), cli.Cache, "myserver.com", certPEM, keyPEM)).To(Succeed())
+
+		got, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "myserver.com"})
+		Expect(err).To(Succeed())
+		Expect(got.Leaf.SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+		Expect(issuer.IssueCalls()).To(BeEmpty())
+
+		cli.RenewBefore = time.Until(cert.Leaf.NotAfter) + time.Minute
+		got, err = cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "myserver.com"})
+		Expect(err).To(Succeed())
+		Expect(got.Leaf.SerialNumber).NotTo(Equal(cert.Leaf.SerialNumber))
+		Expect(issuer.IssueCalls()).To(HaveLen(1))
+	})
+
+	It("rejects a private key not matching the certificate", func() {
+		other, err := generateCertAndKey("myserver.com", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+		certPEM, _ := encodeKeyPair(cert)
+		_, keyPEM := encodeKeyPair(other)
+
+		cache := certify.NewMemCache()
+		Expect(certify.Import(context.Background(), cache, "myserver.com", certPEM, keyPEM)).NotTo(Succeed())
+		_, err = cache.Get(context.Background(), "myserver.com")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+	})
+
+	It("rejects an expired certificate", func() {
+		expired, err := generateExpiredCert()
+		Expect(err).To(Succeed())
+		certPEM, keyPEM := encodeKeyPair(expired)
+
+		err = certify.Import(context.Background(), certify.NewMemCache(), "myserver.com", certPEM, keyPEM)
+		Expect(err).To(MatchError(ContainSubstring("expired")))
+	})
+
+	It("stores the certificate under the normalized name", func() {
+		cli := &certify.Certify{
+			CommonName: "myserver.com",
+			Issuer:     &mocks.IssuerMock{},
+			Cache:      certify.NewMemCache(),
+		}
+		certPEM, keyPEM := encodeKeyPair(cert)
+		Expect(certify.Import(context.Background(), cli.Cache, "MyServer.com.", certPEM, keyPEM)).To(Succeed())
+
+		got, err := cli.GetCertificate(&tls.ClientHelloInfo{ServerName: "myserver.com"})
+		Expect(err).To(Succeed())
+		Expect(got.Leaf.SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+	})
+
+	It("serves a client certificate imported for a mixed-case CommonName", func() {
+		issuer := &mocks.IssuerMock{
+			IssueFunc: func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+				return generateCertAndKey("myserver.com", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+					return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				})
+			},
+		}
+		cli := &certify.Certify{
+			CommonName: "MyServer.com",
+			Issuer:     issuer,
+			Cache:      certify.NewMemCache(),
+		}
+		certPEM, keyPEM := encodeKeyPair(cert)
+		Expect(certify.Import(context.Background(), cli.Cache, cli.CommonName, certPEM, keyPEM)).To(Succeed())
+
+		got, err := cli.GetClientCertificate(&tls.CertificateRequestInfo{})
+		Expect(err).To(Succeed())
+		Expect(got.Leaf.SerialNumber).To(Equal(cert.Leaf.SerialNumber))
+		Expect(issuer.IssueCalls()).To(BeEmpty())
+	})
+
+	It("rejects an empty name", func() {
+		certPEM, keyPEM := encodeKeyPair(cert)
+		Expect(certify.Import(context.Background(), certify.NewMemCache(), "", certPEM, keyPEM)).NotTo(Succeed())
+	})
+
+	Context("with a PKCS#12 file", func() {
+		// testdata/myserver.p12 holds a certificate for myserver.com, its
+		// private key and the CA certificate, encrypted with the password
+		// "certify". It was created with
+		//
+		//	openssl pkcs12 -export -legacy -inkey leaf.key -in leaf.crt \
+		//		-certfile ca.crt -passout pass:certify -out myserver.p12
+		//
+		// testdata/myserver-aes.p12 was created the same way, without -legacy.
+		var data []byte
+
+		BeforeEach(func() {
+			var err error
+			data, err = ioutil.ReadFile("testdata/myserver.p12")
+			Expect(err).To(Succeed())
+		})
+
+		It("stores the certificate and its chain in the cache", func() {
+			cache := certify.NewMemCache()
+			Expect(certify.ImportPKCS12(context.Background(), cache, "myserver.com", data, "certify")).To(Succeed())
+
+			got, err := cache.Get(context.Background(), "myserver.com")
+			Expect(err).To(Succeed())
+			Expect(got.Certificate).To(HaveLen(2))
+			Expect(got.Leaf.DNSNames).To(Equal([]string{"myserver.com"}))
+			ca, err := x509.ParseCertificate(got.Certificate[1])
+			Expect(err).To(Succeed())
+			Expect(ca.Subject.CommonName).To(Equal("Certify Test CA"))
+			Expect(got.Leaf.CheckSignatureFrom(ca)).To(Succeed())
+		})
+
+		It("rejects an incorrect password", func() {
+			err := certify.ImportPKCS12(context.Background(), certify.NewMemCache(), "myserver.com", data, "wrong")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reads files encrypted with AES", func() {
+			data, err := ioutil.ReadFile("testdata/myserver-aes.p12")
+			Expect(err).To(Succeed())
+			cache := certify.NewMemCache()
+			Expect(certify.ImportPKCS12(context.Background(), cache, "myserver.com", data, "certify")).To(Succeed())
+
+			got, err := cache.Get(context.Background(), "myserver.com")
+			Expect(err).To(Succeed())
+			Expect(got.Certificate).To(HaveLen(2))
+			Expect(got.Leaf.DNSNames).To(Equal([]string{"myserver.com"}))
+		})
+	})
+})
@@ -0,0 +1,30 @@
+// Package logging contains helpers for logging
+// from the issuers and caches in this module.
+package logging
+
+// Logger has the same method set as certify.Logger,
+// which can't be imported here without an import cycle.
+type Logger interface {
+	Trace(msg string, fields ...map[string]interface{})
+	Debug(msg string, fields ...map[string]interface{})
+	Info(msg string, fields ...map[string]interface{})
+	Warn(msg string, fields ...map[string]interface{})
+	Error(msg string, fields ...map[string]interface{})
+}
+
+// OrNoop returns the logger, or a logger
+// discarding all events if it is nil.
+func OrNoop(l Logger) Logger {
+	if l == nil {
+		return noop{}
+	}
+	return l
+}
+
+type noop struct{}
+
+func (noop) Trace(string, ...map[string]interface{}) {}
+func (noop) Debug(string, ...map[string]interface{}) {}
+func (noop) Info(string, ...map[string]interface{})  {}
+func (noop) Warn(string, ...map[string]interface{})  {}
+func (noop) Error(string, ...map[string]interface{}) {}
@@ -0,0 +1,73 @@
+// Package testcert generates certificates for tests.
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Generate returns a self-signed certificate with an ECDSA
+// private key, valid until notAfter and for the DNS names.
+func Generate(t testing.TB, notAfter time.Time, dnsNames ...string) *tls.Certificate {
+	t.Helper()
+	return generate(t, notAfter, false, nil, dnsNames...)
+}
+
+// GenerateCA returns a self-signed CA certificate
+// with an ECDSA private key, valid until notAfter.
+func GenerateCA(t testing.TB, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+	return generate(t, notAfter, true, nil)
+}
+
+// GenerateSigned returns a certificate with an ECDSA private key, valid
+// until notAfter and signed by the parent, followed by the chain of the parent.
+func GenerateSigned(t testing.TB, notAfter time.Time, parent *tls.Certificate) *tls.Certificate {
+	t.Helper()
+	return generate(t, notAfter, false, parent)
+}
+
+func generate(t testing.TB, notAfter time.Time, isCA bool, parent *tls.Certificate, dnsNames ...string) *tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1234),
+		Subject:               pkix.Name{CommonName: "Certify Test Cert"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		DNSNames:              dnsNames,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	issuer, signer := template, interface{}(priv)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, priv.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+	if parent != nil {
+		cert.Certificate = append(cert.Certificate, parent.Certificate...)
+	}
+	return cert
+}
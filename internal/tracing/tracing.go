@@ -0,0 +1,28 @@
+// Package tracing contains helpers for tracing
+// the operations of certify with OpenTelemetry.
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/johanbrandhorst/certify"
+
+// Tracer returns the certify tracer of the provider.
+// If the provider is nil, a no-op tracer is returned.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// End records the error, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -14,11 +14,42 @@ type Issuer interface {
 	Issue(context.Context, string, *CertConfig) (*tls.Certificate, error)
 }
 
+// NamedIssuer implements the Issuer interface by wrapping another
+// Issuer with a name, used to identify it in metrics, logs and traces.
+// Without a name, issuers are identified by their type, so two
+// issuers of the same type, for example two Vault clusters,
+// can't be told apart.
+//
+// Name and Issuer are required.
+type NamedIssuer struct {
+	// Name identifies the issuer, for example "vault-eu".
+	Name string
+	// Issuer is the Issuer to issue certificates from.
+	Issuer Issuer
+}
+
+// Issue issues a certificate from the wrapped Issuer.
+func (n *NamedIssuer) Issue(ctx context.Context, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	return n.Issuer.Issue(ctx, commonName, conf)
+}
+
 // KeyGenerator defines an interface used to generate a private key.
 type KeyGenerator interface {
 	Generate() (crypto.PrivateKey, error)
 }
 
+// CertVariant configures one of several certificates
+// maintained per name, each using a different key type.
+type CertVariant struct {
+	// Name identifies the variant. It must be unique
+	// among the variants, and is appended to the cache key
+	// of certificates of this variant, for example "rsa".
+	Name string
+	// KeyGenerator is used to create new private keys
+	// for certificates of this variant.
+	KeyGenerator KeyGenerator
+}
+
 // CertConfig configures the specifics of the certificate
 // requested from the Issuer.
 type CertConfig struct {
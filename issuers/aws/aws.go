@@ -11,11 +11,16 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/johanbrandhorst/certify"
 	"github.com/johanbrandhorst/certify/internal/csr"
+	"github.com/johanbrandhorst/certify/internal/logging"
+	"github.com/johanbrandhorst/certify/internal/tracing"
 )
 
 // Issuer implements the Issuer interface with a
@@ -42,66 +47,100 @@ type Issuer struct {
 	// If unset, defaults to 30 days.
 	TimeToLive int
 
-	initOnce sync.Once
-	initErr  error
-	caCert   *x509.Certificate
+	// TracerProvider configures tracing of requests
+	// to AWS with OpenTelemetry. Defaults to no tracing.
+	TracerProvider trace.TracerProvider
+
+	// Logger configures logging of requests
+	// to AWS. Defaults to no logging.
+	Logger certify.Logger
+}
+
+// caKey identifies the CA of an Issuer.
+type caKey struct {
+	client *acmpca.Client
+	arn    string
+}
+
+// caState holds the signing algorithm of a CA,
+// determined from its certificate.
+type caState struct {
+	mu       sync.Mutex
+	done     bool
 	signAlgo types.SigningAlgorithm
-	waiter   *acmpca.CertificateIssuedWaiter
+}
+
+// caStates holds the caState of each CA. Issuer is used by value,
+// so the state is shared between copies of it through this map.
+var caStates sync.Map
+
+// signingAlgorithm returns the signing algorithm of the CA, fetching the
+// CA certificate on the first call. It's retried on the next call if it fails.
+func (i Issuer) signingAlgorithm(ctx context.Context, tracer trace.Tracer) (types.SigningAlgorithm, error) {
+	v, _ := caStates.LoadOrStore(caKey{client: i.Client, arn: i.CertificateAuthorityARN}, &caState{})
+	state := v.(*caState)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.done {
+		return state.signAlgo, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "acmpca.GetCertificateAuthorityCertificate", trace.WithSpanKind(trace.SpanKindClient))
+	caResp, err := i.Client.GetCertificateAuthorityCertificate(ctx, &acmpca.GetCertificateAuthorityCertificateInput{
+		CertificateAuthorityArn: aws.String(i.CertificateAuthorityARN),
+	})
+	tracing.End(span, err)
+	if err != nil {
+		return "", classifyError(err)
+	}
+
+	caBlock, _ := pem.Decode([]byte(*caResp.Certificate))
+	if caBlock == nil {
+		return "", errors.New("could not parse AWS CA cert")
+	}
+
+	if caBlock.Type != "CERTIFICATE" {
+		return "", errors.New("saw unexpected PEM Type while requesting AWS CA cert: " + caBlock.Type)
+	}
+
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	switch caCert.SignatureAlgorithm {
+	case x509.SHA256WithRSA:
+		state.signAlgo = types.SigningAlgorithmSha256withrsa
+	case x509.SHA384WithRSA:
+		state.signAlgo = types.SigningAlgorithmSha384withrsa
+	case x509.SHA512WithRSA:
+		state.signAlgo = types.SigningAlgorithmSha512withrsa
+	case x509.ECDSAWithSHA256:
+		state.signAlgo = types.SigningAlgorithmSha256withecdsa
+	case x509.ECDSAWithSHA384:
+		state.signAlgo = types.SigningAlgorithmSha384withecdsa
+	case x509.ECDSAWithSHA512:
+		state.signAlgo = types.SigningAlgorithmSha512withecdsa
+	default:
+		return "", fmt.Errorf("unsupported CA cert signing algorithm: %T", caCert.SignatureAlgorithm)
+	}
+
+	state.done = true
+	return state.signAlgo, nil
 }
 
 // Issue issues a certificate from the configured AWS CA backend.
+// The CA certificate is fetched on the first call, and reused after.
 func (i Issuer) Issue(ctx context.Context, commonName string, conf *certify.CertConfig) (*tls.Certificate, error) {
-	i.initOnce.Do(func() {
-		i.waiter = acmpca.NewCertificateIssuedWaiter(i.Client)
-
-		caResp, err := i.Client.GetCertificateAuthorityCertificate(ctx, &acmpca.GetCertificateAuthorityCertificateInput{
-			CertificateAuthorityArn: aws.String(i.CertificateAuthorityARN),
-		})
-		if err != nil {
-			i.initErr = err
-			return
-		}
-
-		caBlock, _ := pem.Decode([]byte(*caResp.Certificate))
-		if caBlock == nil {
-			i.initErr = errors.New("could not parse AWS CA cert")
-			return
-		}
-
-		if caBlock.Type != "CERTIFICATE" {
-			i.initErr = errors.New("saw unexpected PEM Type while requesting AWS CA cert: " + caBlock.Type)
-			return
-		}
-
-		i.caCert, err = x509.ParseCertificate(caBlock.Bytes)
-		if err != nil {
-			i.initErr = err
-			return
-		}
-
-		switch i.caCert.SignatureAlgorithm {
-		case x509.SHA256WithRSA:
-			i.signAlgo = types.SigningAlgorithmSha256withrsa
-		case x509.SHA384WithRSA:
-			i.signAlgo = types.SigningAlgorithmSha384withrsa
-		case x509.SHA512WithRSA:
-			i.signAlgo = types.SigningAlgorithmSha512withrsa
-		case x509.ECDSAWithSHA256:
-			i.signAlgo = types.SigningAlgorithmSha256withecdsa
-		case x509.ECDSAWithSHA384:
-			i.signAlgo = types.SigningAlgorithmSha384withecdsa
-		case x509.ECDSAWithSHA512:
-			i.signAlgo = types.SigningAlgorithmSha512withecdsa
-		default:
-			i.initErr = fmt.Errorf("unsupported CA cert signing algorithm: %T", i.caCert.SignatureAlgorithm)
-			return
-		}
-	})
-	if i.initErr != nil {
-		return nil, i.initErr
+	tracer := tracing.Tracer(i.TracerProvider)
+	signAlgo, err := i.signingAlgorithm(ctx, tracer)
+	if err != nil {
+		return nil, err
 	}
 
+	_, span := tracer.Start(ctx, "certify.csr.FromCertConfig")
 	csrPEM, keyPEM, err := csr.FromCertConfig(commonName, conf)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -112,25 +151,44 @@ func (i Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cert
 		ttl = int64(i.TimeToLive)
 	}
 
-	issueResp, err := i.Client.IssueCertificate(ctx, &acmpca.IssueCertificateInput{
+	logger := logging.OrNoop(i.Logger)
+	fields := map[string]interface{}{
+		certify.LogFieldName:   commonName,
+		certify.LogFieldIssuer: fmt.Sprintf("%T", i),
+	}
+	logger.Debug("Requesting certificate from AWS", fields)
+
+	start := time.Now()
+	issueCtx, span := tracer.Start(ctx, "acmpca.IssueCertificate", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("aws.acmpca.certificate_authority_arn", i.CertificateAuthorityARN),
+	))
+	issueResp, err := i.Client.IssueCertificate(issueCtx, &acmpca.IssueCertificateInput{
 		CertificateAuthorityArn: aws.String(i.CertificateAuthorityARN),
 		Csr:                     csrPEM,
-		SigningAlgorithm:        i.signAlgo,
+		SigningAlgorithm:        signAlgo,
 		Validity: &types.Validity{
 			Type:  types.ValidityPeriodTypeDays,
 			Value: aws.Int64(ttl),
 		},
 	})
+	tracing.End(span, err)
 	if err != nil {
-		return nil, err
+		return nil, logError(logger, fields, start, classifyError(err))
+	}
+	fields = map[string]interface{}{
+		certify.LogFieldName:   commonName,
+		certify.LogFieldIssuer: fmt.Sprintf("%T", i),
+		"certificate_arn":      aws.ToString(issueResp.CertificateArn),
 	}
 
-	err = i.waiter.Wait(ctx, &acmpca.GetCertificateInput{
+	waitCtx, span := tracer.Start(ctx, "acmpca.WaitCertificateIssued", trace.WithSpanKind(trace.SpanKindClient))
+	err = acmpca.NewCertificateIssuedWaiter(i.Client).Wait(waitCtx, &acmpca.GetCertificateInput{
 		CertificateArn:          issueResp.CertificateArn,
 		CertificateAuthorityArn: aws.String(i.CertificateAuthorityARN),
 	}, time.Minute)
+	tracing.End(span, err)
 	if err != nil {
-		return nil, err
+		return nil, logError(logger, fields, start, classifyError(err))
 	}
 
 	getReq := &acmpca.GetCertificateInput{
@@ -138,9 +196,11 @@ func (i Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cert
 		CertificateAuthorityArn: aws.String(i.CertificateAuthorityARN),
 	}
 
-	cert, err := i.Client.GetCertificate(ctx, getReq)
+	getCtx, span := tracer.Start(ctx, "acmpca.GetCertificate", trace.WithSpanKind(trace.SpanKindClient))
+	cert, err := i.Client.GetCertificate(getCtx, getReq)
+	tracing.End(span, err)
 	if err != nil {
-		return nil, err
+		return nil, logError(logger, fields, start, classifyError(err))
 	}
 
 	caChainPEM := append(append([]byte(*cert.Certificate), '\n'), []byte(*cert.CertificateChain)...)
@@ -152,5 +212,32 @@ func (i Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cert
 
 	// This can't error since it's called in tls.X509KeyPair above successfully
 	tlsCert.Leaf, _ = x509.ParseCertificate(tlsCert.Certificate[0])
+	logger.Debug("Certificate issued by AWS", fields, map[string]interface{}{
+		certify.LogFieldDuration: time.Since(start),
+		certify.LogFieldSerial:   tlsCert.Leaf.SerialNumber.String(),
+	})
 	return &tlsCert, nil
 }
+
+// logError logs a failed request to issue a certificate.
+func logError(logger logging.Logger, fields map[string]interface{}, start time.Time, err error) error {
+	logger.Warn("Failed to issue certificate with AWS", fields, map[string]interface{}{
+		certify.LogFieldDuration: time.Since(start),
+		certify.LogFieldError:    err.Error(),
+	})
+	return err
+}
+
+// classifyError wraps errors returned from the AWS API
+// in certify.RetryableError or certify.PermanentError.
+func classifyError(err error) error {
+	var inProgress *types.RequestInProgressException
+	if errors.As(err, &inProgress) ||
+		retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return &certify.RetryableError{Err: err}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &certify.PermanentError{Err: err}
+}
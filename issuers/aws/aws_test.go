@@ -15,15 +15,20 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	api "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca/types"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/johanbrandhorst/certify"
 	"github.com/johanbrandhorst/certify/issuers/aws"
+	"github.com/johanbrandhorst/certify/mocks"
 )
 
 func TestIssuer(t *testing.T) {
@@ -35,14 +40,15 @@ func TestIssuer(t *testing.T) {
 			t.Fatal(err)
 		}
 		ttl := 25
-		server := httptest.NewTLSServer(&fakeACMPCA{
+		fake := &fakeACMPCA{
 			t:            t,
 			certARN:      certARN,
 			caARN:        caARN,
 			caCert:       caCert,
 			caKey:        caKey,
 			validityDays: ttl,
-		})
+		}
+		server := httptest.NewTLSServer(fake)
 
 		client := acmpca.NewFromConfig(api.Config{
 			HTTPClient: server.Client(),
@@ -52,10 +58,14 @@ func TestIssuer(t *testing.T) {
 				}, nil
 			}),
 		})
-		iss := &aws.Issuer{
+		logger := &mocks.LoggerMock{
+			DebugFunc: func(string, ...map[string]interface{}) {},
+		}
+		iss := aws.Issuer{
 			CertificateAuthorityARN: caARN,
 			Client:                  client,
 			TimeToLive:              ttl,
+			Logger:                  logger,
 		}
 		cn := "somename.com"
 		conf := &certify.CertConfig{
@@ -116,6 +126,89 @@ func TestIssuer(t *testing.T) {
 				time.Now().AddDate(0, 0, iss.TimeToLive).Add(5*time.Second),
 			)
 		}
+
+		calls := logger.DebugCalls()
+		if len(calls) != 2 {
+			t.Fatalf("Unexpected number of debug logs, got %d wanted %d", len(calls), 2)
+		}
+		fields := map[string]interface{}{}
+		for _, f := range calls[1].Fields {
+			for k, v := range f {
+				fields[k] = v
+			}
+		}
+		if fields[certify.LogFieldName] != cn {
+			t.Fatalf("Unexpected name logged, got %v wanted %s", fields[certify.LogFieldName], cn)
+		}
+		if fields[certify.LogFieldSerial] != tlsCert.Leaf.SerialNumber.String() {
+			t.Fatalf("Unexpected serial logged, got %v wanted %s", fields[certify.LogFieldSerial], tlsCert.Leaf.SerialNumber)
+		}
+		if _, ok := fields[certify.LogFieldDuration].(time.Duration); !ok {
+			t.Fatalf("Expected duration to be logged, got %v", fields[certify.LogFieldDuration])
+		}
+
+		if _, err := iss.Issue(context.Background(), cn, conf); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&fake.caRequests); n != 1 {
+			t.Fatalf("Expected the CA certificate to be fetched once, got %d requests", n)
+		}
+	})
+
+	t.Run("It traces requests to AWS", func(t *testing.T) {
+		caARN := "someARN"
+		certARN := "anotherARN"
+		caCert, caKey, err := generateCertAndKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewTLSServer(&fakeACMPCA{
+			t:            t,
+			certARN:      certARN,
+			caARN:        caARN,
+			caCert:       caCert,
+			caKey:        caKey,
+			validityDays: 30,
+		})
+
+		client := acmpca.NewFromConfig(api.Config{
+			HTTPClient: server.Client(),
+			EndpointResolver: api.EndpointResolverFunc(func(service, region string) (api.Endpoint, error) {
+				return api.Endpoint{
+					URL: server.URL,
+				}, nil
+			}),
+		})
+		sr := tracetest.NewSpanRecorder()
+		iss := &aws.Issuer{
+			CertificateAuthorityARN: caARN,
+			Client:                  client,
+			TracerProvider:          sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)),
+		}
+		conf := &certify.CertConfig{
+			KeyGenerator: keyGeneratorFunc(func() (crypto.PrivateKey, error) {
+				return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			}),
+		}
+		_, err = iss.Issue(context.Background(), "somename.com", conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, span := range sr.Ended() {
+			names = append(names, span.Name())
+		}
+		expected := []string{
+			"acmpca.GetCertificateAuthorityCertificate",
+			"certify.csr.FromCertConfig",
+			"acmpca.IssueCertificate",
+			"acmpca.WaitCertificateIssued",
+			"acmpca.GetCertificate",
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("Unexpected spans %v, wanted %v", names, expected)
+		}
 	})
 }
 
@@ -128,11 +221,13 @@ type fakeACMPCA struct {
 	validityDays int
 
 	signedCertPEM []byte
+	caRequests    int32
 }
 
 func (f *fakeACMPCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Header.Get("X-Amz-Target") {
 	case "ACMPrivateCA.GetCertificateAuthorityCertificate":
+		atomic.AddInt32(&f.caRequests, 1)
 		f.ServeGetCertificateAuthorityCertificate(w, r)
 		return
 	case "ACMPrivateCA.IssueCertificate":
@@ -5,15 +5,24 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/cfssl/api/client"
 	"github.com/cloudflare/cfssl/auth"
+	cfsslerrors "github.com/cloudflare/cfssl/errors"
 	"github.com/cloudflare/cfssl/signer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/johanbrandhorst/certify"
 	"github.com/johanbrandhorst/certify/internal/csr"
+	"github.com/johanbrandhorst/certify/internal/logging"
+	"github.com/johanbrandhorst/certify/internal/tracing"
 )
 
 // Issuer implements the Issuer interface
@@ -33,6 +42,14 @@ type Issuer struct {
 	// Auth optionally configures the authentication
 	// that should be used.
 	Auth auth.Provider
+	// TracerProvider configures tracing of requests
+	// to the CFSSL server with OpenTelemetry.
+	// Defaults to no tracing.
+	TracerProvider trace.TracerProvider
+
+	// Logger configures logging of requests
+	// to the CFSSL server. Defaults to no logging.
+	Logger certify.Logger
 
 	remote        client.Remote
 	remoteCertPEM []byte
@@ -71,7 +88,7 @@ func (i *Issuer) connect(ctx context.Context) error {
 	// Use the Info endpoint as a PING to check server availability
 	resp, err := i.remote.Info([]byte(`{}`))
 	if err != nil {
-		return err
+		return classifyError(err)
 	}
 
 	i.remoteCertPEM = []byte(resp.Certificate)
@@ -81,23 +98,68 @@ func (i *Issuer) connect(ctx context.Context) error {
 
 // Issue issues a certificate with the provided options.
 func (i *Issuer) Issue(ctx context.Context, commonName string, conf *certify.CertConfig) (*tls.Certificate, error) {
+	tracer := tracing.Tracer(i.TracerProvider)
 	if i.remote == nil {
-		err := i.connect(ctx)
+		connectCtx, span := tracer.Start(ctx, "cfssl.info", trace.WithSpanKind(trace.SpanKindClient))
+		err := i.connect(connectCtx)
+		tracing.End(span, err)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Add context to requests
-	i.remote.SetReqModifier(func(req *http.Request, _ []byte) {
-		*req = *req.WithContext(ctx)
-	})
-
+	_, span := tracer.Start(ctx, "certify.csr.FromCertConfig")
 	csrPEM, keyPEM, err := csr.FromCertConfig(commonName, conf)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.OrNoop(i.Logger)
+	fields := map[string]interface{}{
+		certify.LogFieldName:   commonName,
+		certify.LogFieldIssuer: fmt.Sprintf("%T", i),
+		"profile":              i.Profile,
+	}
+	logger.Debug("Requesting certificate from CFSSL", fields)
+
+	start := time.Now()
+	signCtx, span := tracer.Start(ctx, "cfssl.sign", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("cfssl.profile", i.Profile),
+	))
+	certPEM, err := i.sign(signCtx, csrPEM)
+	tracing.End(span, err)
+	dur := time.Since(start)
 	if err != nil {
+		logger.Warn("Failed to sign certificate with CFSSL", fields, map[string]interface{}{
+			certify.LogFieldDuration: dur,
+			certify.LogFieldError:    err.Error(),
+		})
 		return nil, err
 	}
 
+	caChainPEM := append(append(certPEM, '\n'), i.remoteCertPEM...)
+	tlsCert, err := tls.X509KeyPair(caChainPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// This can't error since it's called in tls.X509KeyPair above successfully
+	tlsCert.Leaf, _ = x509.ParseCertificate(tlsCert.Certificate[0])
+	logger.Debug("Certificate signed by CFSSL", fields, map[string]interface{}{
+		certify.LogFieldDuration: dur,
+		certify.LogFieldSerial:   tlsCert.Leaf.SerialNumber.String(),
+	})
+	return &tlsCert, nil
+}
+
+// sign sends the CSR to the CFSSL server to be signed.
+func (i *Issuer) sign(ctx context.Context, csrPEM []byte) ([]byte, error) {
+	// Add context to requests
+	i.remote.SetReqModifier(func(req *http.Request, _ []byte) {
+		*req = *req.WithContext(ctx)
+	})
+
 	req := signer.SignRequest{
 		Request: string(csrPEM),
 		Profile: i.Profile,
@@ -115,16 +177,31 @@ func (i *Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cer
 		certPEM, err = i.remote.Sign(reqBytes)
 	}
 	if err != nil {
-		return nil, err
+		return nil, classifyError(err)
 	}
 
-	caChainPEM := append(append(certPEM, '\n'), i.remoteCertPEM...)
-	tlsCert, err := tls.X509KeyPair(caChainPEM, keyPEM)
-	if err != nil {
-		return nil, err
-	}
+	return certPEM, nil
+}
 
-	// This can't error since it's called in tls.X509KeyPair above successfully
-	tlsCert.Leaf, _ = x509.ParseCertificate(tlsCert.Certificate[0])
-	return &tlsCert, nil
+// classifyError wraps errors returned from the CFSSL API
+// in certify.RetryableError or certify.PermanentError.
+// Errors reading responses, and requests to the server that
+// timed out or whose connection was reset are retryable, other
+// errors are permanent. The CFSSL client only keeps the message
+// of the errors making requests, so they're told apart by it.
+func classifyError(err error) error {
+	var cfsslErr *cfsslerrors.Error
+	if !errors.As(err, &cfsslErr) {
+		return err
+	}
+	switch cfsslErr.ErrorCode {
+	case int(cfsslerrors.APIClientError) + int(cfsslerrors.IOError):
+		return &certify.RetryableError{Err: err}
+	case int(cfsslerrors.APIClientError) + int(cfsslerrors.ClientHTTPError):
+		msg := strings.ToLower(cfsslErr.Message)
+		if strings.Contains(msg, "timeout") || strings.Contains(msg, "connection reset") {
+			return &certify.RetryableError{Err: err}
+		}
+	}
+	return &certify.PermanentError{Err: err}
 }
@@ -5,15 +5,20 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/johanbrandhorst/certify"
 	"github.com/johanbrandhorst/certify/internal/csr"
+	"github.com/johanbrandhorst/certify/internal/logging"
+	"github.com/johanbrandhorst/certify/internal/tracing"
 )
 
 // Issuer implements the Issuer interface with a
@@ -87,6 +92,15 @@ type Issuer struct {
 	// and using this setting will ignore any SANs in the CSR.
 	OtherSubjectAlternativeNames []string
 
+	// TracerProvider configures tracing of requests
+	// to the Vault server with OpenTelemetry.
+	// Defaults to no tracing.
+	TracerProvider trace.TracerProvider
+
+	// Logger configures logging of requests
+	// to the Vault server. Defaults to no logging.
+	Logger certify.Logger
+
 	cli *api.Client
 }
 
@@ -135,7 +149,10 @@ func (v *Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cer
 		v.AuthMethod = ConstantToken(v.Token)
 	}
 
+	tracer := tracing.Tracer(v.TracerProvider)
+	_, span := tracer.Start(ctx, "certify.csr.FromCertConfig")
 	csrPEM, keyPEM, err := csr.FromCertConfig(commonName, conf)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -152,14 +169,36 @@ func (v *Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cer
 		TimeToLive:        ttl(v.TimeToLive),
 	}
 
-	secret, err := v.signCSR(ctx, opts)
-	if err != nil {
-		return nil, err
+	logger := logging.OrNoop(v.Logger)
+	fields := map[string]interface{}{
+		certify.LogFieldName:   commonName,
+		certify.LogFieldIssuer: fmt.Sprintf("%T", v),
+		"role":                 v.Role,
 	}
-	if secret == nil {
+	logger.Debug("Requesting certificate from Vault", fields)
+
+	start := time.Now()
+	signCtx, span := tracer.Start(ctx, "vault.sign", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("vault.role", v.Role),
+		attribute.String("vault.mount", v.Mount),
+	))
+	secret, err := v.signCSR(signCtx, opts)
+	tracing.End(span, err)
+	dur := time.Since(start)
+	if err == nil && secret == nil {
 		// This can happen if the Vault server is sealed or
 		// there are temporary connection issues.
-		return nil, errors.New("no secret returned from Vault, please try again")
+		err = &certify.RetryableError{
+			Err: errors.New("no secret returned from Vault, please try again"),
+		}
+	}
+	if err != nil {
+		err = classifyError(err)
+		logger.Warn("Failed to sign certificate with Vault", fields, map[string]interface{}{
+			certify.LogFieldDuration: dur,
+			certify.LogFieldError:    err.Error(),
+		})
+		return nil, err
 	}
 
 	// https://www.vaultproject.io/api/secret/pki/index.html#sample-response-15
@@ -180,6 +219,10 @@ func (v *Issuer) Issue(ctx context.Context, commonName string, conf *certify.Cer
 
 	// This can't error since it's called in tls.X509KeyPair above successfully
 	tlsCert.Leaf, _ = x509.ParseCertificate(tlsCert.Certificate[0])
+	logger.Debug("Certificate signed by Vault", fields, map[string]interface{}{
+		certify.LogFieldDuration: dur,
+		certify.LogFieldSerial:   tlsCert.Leaf.SerialNumber.String(),
+	})
 	return &tlsCert, nil
 }
 
@@ -223,3 +266,17 @@ func (v Issuer) signCSR(ctx context.Context, opts csrOpts) (*api.Secret, error)
 
 	return api.ParseSecret(resp.Body)
 }
+
+// classifyError wraps errors returned from the Vault API
+// in certify.RetryableError or certify.PermanentError
+// depending on the status code of the response.
+func classifyError(err error) error {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) {
+		return err
+	}
+	if respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= 500 {
+		return &certify.RetryableError{Err: err}
+	}
+	return &certify.PermanentError{Err: err}
+}
@@ -0,0 +1,110 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrIssueLimited is returned when a request to the Issuer
+// could not be made within the rate or concurrency limits
+// before the context of the request was done.
+var ErrIssueLimited = errors.New("certificate issuance limit exceeded")
+
+// issueLimiter bounds the rate and concurrency
+// of requests to an Issuer.
+type issueLimiter struct {
+	limiter *rate.Limiter
+	sem     chan struct{}
+}
+
+func newIssueLimiter(limit rate.Limit, burst, maxInFlight int) *issueLimiter {
+	l := &issueLimiter{}
+	if limit > 0 {
+		if burst <= 0 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(limit, burst)
+	}
+	if maxInFlight > 0 {
+		l.sem = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// acquire waits until a request may be made, returning
+// a function to call once the request is done.
+func (l *issueLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem != nil {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: waiting for in-flight requests: %v", ErrIssueLimited, ctx.Err())
+		case l.sem <- struct{}{}:
+		}
+	}
+	release := func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+
+	if l.limiter != nil {
+		// Wait returns immediately if the wait would
+		// exceed the deadline of the context.
+		if err := l.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, fmt.Errorf("%w: waiting for rate limit: %v", ErrIssueLimited, err)
+		}
+	}
+
+	return release, nil
+}
+
+// LimitIssuer implements the Issuer interface by wrapping
+// another Issuer, limiting the rate and concurrency of requests.
+// Requests exceeding the limits wait their turn, until the
+// context of the request is done, at which point ErrIssueLimited
+// is returned. It can be used to configure limits per issuer,
+// for example in a MultiIssuer. See the corresponding fields on
+// Certify to configure limits across all issuers.
+//
+// Issuer is required.
+type LimitIssuer struct {
+	// Issuer is the Issuer to limit requests to.
+	Issuer Issuer
+
+	// RateLimit is the sustained rate of requests, per second,
+	// allowed to the Issuer. Defaults to no limit.
+	RateLimit rate.Limit
+
+	// Burst is the number of requests allowed to exceed the
+	// RateLimit at once. Defaults to 1.
+	Burst int
+
+	// MaxInFlight is the maximum number of concurrent
+	// requests to the Issuer. Defaults to no limit.
+	MaxInFlight int
+
+	initOnce sync.Once
+	limiter  *issueLimiter
+}
+
+// Issue issues a certificate from the wrapped Issuer
+// once allowed by the configured limits.
+func (l *LimitIssuer) Issue(ctx context.Context, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	l.initOnce.Do(func() {
+		l.limiter = newIssueLimiter(l.RateLimit, l.Burst, l.MaxInFlight)
+	})
+
+	release, err := l.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return l.Issuer.Issue(ctx, commonName, conf)
+}
@@ -0,0 +1,169 @@
+package certify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockExt = ".lock"
+
+	defaultLockTTL       = 5 * time.Minute
+	defaultLockRetryWait = 250 * time.Millisecond
+)
+
+// Locker describes the interface that locks shared between
+// instances of a service must implement. When configured, Certify
+// holds the lock for a name while issuing its certificate, and checks
+// the cache again once it has the lock, so instances sharing a Cache
+// don't all issue a certificate for the same name at the same time.
+//
+// Locks should expire after a while, so that an instance
+// crashing while holding a lock doesn't block the others
+// forever. Locker implementations must be thread safe.
+type Locker interface {
+	// Lock blocks until the lock for the key is acquired, or the
+	// context is done, in which case it returns the context error.
+	// It returns a function releasing the lock.
+	Lock(ctx context.Context, key string) (unlock func() error, err error)
+}
+
+// FileLocker implements Locker using lock files in a directory,
+// for example the directory of a DirCache shared between instances
+// on a network volume. If the directory does not exist, it will be
+// created with 0700 permissions.
+//
+// Lock files are created exclusively, which is supported by network
+// file systems, unlike advisory file locks. Lock files older than
+// TTL are assumed to be left behind by a crashed instance, and
+// are replaced. Lock files are renamed before they are removed, so
+// that when several instances replace an expired lock file at the
+// same time, only one of them acquires the lock. The file system
+// must support hard links.
+type FileLocker struct {
+	// Dir is the directory lock files are created in.
+	Dir string
+
+	// TTL is how long a lock can be held before it expires.
+	// It should be longer than the Certify IssueTimeout.
+	// Defaults to 5 minutes.
+	TTL time.Duration
+}
+
+// Lock acquires the lock for the key by creating the lock file
+// of the key, waiting for it to be released or expire if it exists.
+func (f *FileLocker) Lock(ctx context.Context, key string) (func() error, error) {
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	ttl := f.TTL
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(f.Dir, key+lockExt)
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, err = file.Write(token)
+			if cErr := file.Close(); err == nil {
+				err = cErr
+			}
+			if err != nil {
+				return nil, removeWrapErr(path, err)
+			}
+			return func() error {
+				return unlockFile(path, token)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > ttl {
+			// Left behind by a crashed instance. Another instance may
+			// replace it first, so check it again once it's ours.
+			err := removeLockFile(path, token, func(info os.FileInfo, _ []byte) bool {
+				return time.Since(info.ModTime()) > ttl
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(defaultLockRetryWait):
+		}
+	}
+}
+
+// unlockFile removes the lock file, unless it has expired
+// and been replaced by the lock file of another instance.
+func unlockFile(path string, token []byte) error {
+	return removeLockFile(path, token, func(_ os.FileInfo, data []byte) bool {
+		return bytes.Equal(data, token)
+	})
+}
+
+// removeLockFile removes the lock file if remove reports true for it.
+// The lock file is first renamed to a name unique to the holder of the
+// token, which only one instance can do, so a lock file created by
+// another instance after the lock file was checked is never removed.
+// If remove reports false, the lock file is put back.
+func removeLockFile(path string, token []byte, remove func(os.FileInfo, []byte) bool) (err error) {
+	claimed := path + "." + string(token)
+	if err := os.Rename(path, claimed); err != nil {
+		if os.IsNotExist(err) {
+			// Removed by another instance
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		if e := os.Remove(claimed); e != nil && !os.IsNotExist(e) && err == nil {
+			err = e
+		}
+	}()
+
+	info, err := os.Stat(claimed)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(claimed)
+	if err != nil {
+		return err
+	}
+	if remove(info, data) {
+		return nil
+	}
+	// Linking fails if another instance created a lock file while
+	// it was renamed, in which case both instances hold the lock.
+	// This requires two instances to replace the same expired lock
+	// file within the time it takes to rename and check it.
+	if err := os.Link(claimed, path); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lockToken returns a random token identifying the holder of a lock.
+func lockToken() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(b)), nil
+}
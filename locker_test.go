@@ -0,0 +1,127 @@
+package certify_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+var _ = Describe("FileLocker", func() {
+	var (
+		dir    string
+		locker *certify.FileLocker
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).To(Succeed())
+		locker = &certify.FileLocker{Dir: filepath.Join(dir, "locks")}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("blocks until the lock is released", func() {
+		unlock, err := locker.Lock(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+
+		acquired := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(acquired)
+			unlock, err := locker.Lock(context.Background(), "myserver.com")
+			Expect(err).To(Succeed())
+			Expect(unlock()).To(Succeed())
+		}()
+
+		Consistently(acquired, 300*time.Millisecond).ShouldNot(BeClosed())
+		// Other keys aren't locked
+		otherUnlock, err := locker.Lock(context.Background(), "otherserver.com")
+		Expect(err).To(Succeed())
+		Expect(otherUnlock()).To(Succeed())
+
+		Expect(unlock()).To(Succeed())
+		Eventually(acquired).Should(BeClosed())
+	})
+
+	It("returns when the context is done", func() {
+		unlock, err := locker.Lock(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+		defer unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = locker.Lock(ctx, "myserver.com")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("replaces expired locks", func() {
+		locker.TTL = time.Minute
+		unlock, err := locker.Lock(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+		path := filepath.Join(locker.Dir, "myserver.com.lock")
+		old := time.Now().Add(-2 * time.Minute)
+		Expect(os.Chtimes(path, old, old)).To(Succeed())
+
+		newUnlock, err := locker.Lock(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+
+		// Releasing the expired lock leaves the new lock alone
+		Expect(unlock()).To(Succeed())
+		Expect(path).To(BeAnExistingFile())
+		Expect(newUnlock()).To(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+
+	It("only lets one instance replace an expired lock", func() {
+		locker.TTL = time.Minute
+		// Left behind by a crashed instance
+		_, err := locker.Lock(context.Background(), "myserver.com")
+		Expect(err).To(Succeed())
+		path := filepath.Join(locker.Dir, "myserver.com.lock")
+		old := time.Now().Add(-2 * time.Minute)
+		Expect(os.Chtimes(path, old, old)).To(Succeed())
+
+		var (
+			wg       sync.WaitGroup
+			inFlight int32
+			overlaps int32
+		)
+		start := make(chan struct{})
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				<-start
+				unlock, err := locker.Lock(context.Background(), "myserver.com")
+				Expect(err).To(Succeed())
+				if atomic.AddInt32(&inFlight, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				Expect(unlock()).To(Succeed())
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&overlaps)).To(BeZero())
+		// Renamed lock files are removed too
+		infos, err := ioutil.ReadDir(locker.Dir)
+		Expect(err).To(Succeed())
+		Expect(infos).To(BeEmpty())
+	})
+})
@@ -0,0 +1,91 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/johanbrandhorst/certify/internal/logging"
+)
+
+// LoggingCache implements the Cache interface by wrapping
+// another Cache, logging every operation and its outcome.
+// It can be used to add logging to caches, such as DirCache,
+// that have no way of configuring a Logger.
+//
+// Cache is required.
+type LoggingCache struct {
+	// Cache is the Cache to log operations of.
+	Cache Cache
+
+	// Logger is used to log the operations. Successful
+	// operations are logged at Debug level, unusable
+	// certificates at Warn level and failed operations
+	// at Error level. Defaults to no logging.
+	Logger Logger
+}
+
+// Get gets a certificate from the wrapped Cache.
+func (l *LoggingCache) Get(ctx context.Context, key string) (*tls.Certificate, error) {
+	start := time.Now()
+	cert, err := l.Cache.Get(ctx, key)
+	fields := map[string]interface{}{
+		LogFieldName:     key,
+		LogFieldDuration: time.Since(start),
+	}
+	switch {
+	case err == ErrCacheMiss:
+		logging.OrNoop(l.Logger).Debug("Certificate not found in cache", fields)
+	case errors.Is(err, ErrCacheMiss):
+		fields[LogFieldError] = err.Error()
+		logging.OrNoop(l.Logger).Warn("Unusable certificate found in cache", fields)
+	case err != nil:
+		fields[LogFieldError] = err.Error()
+		logging.OrNoop(l.Logger).Error("Failed to get certificate from cache", fields)
+	default:
+		if cert.Leaf != nil {
+			fields[LogFieldSerial] = cert.Leaf.SerialNumber.String()
+			fields[LogFieldExpiry] = cert.Leaf.NotAfter.Format(time.RFC3339)
+		}
+		logging.OrNoop(l.Logger).Debug("Certificate found in cache", fields)
+	}
+	return cert, err
+}
+
+// Put puts a certificate in the wrapped Cache.
+func (l *LoggingCache) Put(ctx context.Context, key string, cert *tls.Certificate) error {
+	start := time.Now()
+	err := l.Cache.Put(ctx, key, cert)
+	fields := map[string]interface{}{
+		LogFieldName:     key,
+		LogFieldDuration: time.Since(start),
+	}
+	if cert.Leaf != nil {
+		fields[LogFieldSerial] = cert.Leaf.SerialNumber.String()
+	}
+	if err != nil {
+		fields[LogFieldError] = err.Error()
+		logging.OrNoop(l.Logger).Error("Failed to put certificate in cache", fields)
+		return err
+	}
+	logging.OrNoop(l.Logger).Debug("Certificate put in cache", fields)
+	return nil
+}
+
+// Delete deletes a certificate from the wrapped Cache.
+func (l *LoggingCache) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := l.Cache.Delete(ctx, key)
+	fields := map[string]interface{}{
+		LogFieldName:     key,
+		LogFieldDuration: time.Since(start),
+	}
+	if err != nil {
+		fields[LogFieldError] = err.Error()
+		logging.OrNoop(l.Logger).Error("Failed to delete certificate from cache", fields)
+		return err
+	}
+	logging.OrNoop(l.Logger).Debug("Certificate deleted from cache", fields)
+	return nil
+}
@@ -2,7 +2,12 @@ package certify
 
 // Logger must be implemented to log events. See
 // https://logur.dev/logur for some adapters
-// for popular logging libraries.
+// for popular logging libraries, and the logging/slog
+// package for an adapter for the standard library log/slog.
+//
+// Events logged by Certify, the issuers and the caches in
+// this module use the field names defined by the LogField
+// constants, so that events can be correlated.
 type Logger interface {
 	Trace(msg string, fields ...map[string]interface{})
 	Debug(msg string, fields ...map[string]interface{})
@@ -11,6 +16,25 @@ type Logger interface {
 	Error(msg string, fields ...map[string]interface{})
 }
 
+// Field names of logged events.
+const (
+	// LogFieldName is the server name or cache key
+	// a certificate was requested for.
+	LogFieldName = "name"
+	// LogFieldSerial is the serial number of a certificate.
+	LogFieldSerial = "serial"
+	// LogFieldExpiry is the expiry of a certificate, in RFC3339 format.
+	LogFieldExpiry = "expiry"
+	// LogFieldIssuer identifies the Issuer a certificate was requested from.
+	LogFieldIssuer = "issuer"
+	// LogFieldDuration is the time.Duration an operation took.
+	LogFieldDuration = "duration"
+	// LogFieldAttempt is the number of an attempt, starting at 1.
+	LogFieldAttempt = "attempt"
+	// LogFieldError is the error an operation failed with.
+	LogFieldError = "error"
+)
+
 type noopLogger struct{}
 
 func (*noopLogger) Trace(msg string, fields ...map[string]interface{}) {}
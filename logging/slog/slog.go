@@ -0,0 +1,76 @@
+//go:build go1.21
+// +build go1.21
+
+// Package slog implements an adapter from the standard library
+// log/slog package to the certify.Logger interface.
+package slog
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// LevelTrace is the level Trace events are logged at.
+const LevelTrace = slog.LevelDebug - 4
+
+// Logger implements the certify.Logger interface
+// by logging events to a *slog.Logger.
+type Logger struct {
+	logger *slog.Logger
+}
+
+// New returns a Logger logging events to the logger.
+// If logger is nil, slog.Default() is used.
+func New(logger *slog.Logger) *Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Logger{logger: logger}
+}
+
+// Trace logs an event at LevelTrace.
+func (l *Logger) Trace(msg string, fields ...map[string]interface{}) {
+	l.log(LevelTrace, msg, fields)
+}
+
+// Debug logs an event at slog.LevelDebug.
+func (l *Logger) Debug(msg string, fields ...map[string]interface{}) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+// Info logs an event at slog.LevelInfo.
+func (l *Logger) Info(msg string, fields ...map[string]interface{}) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+// Warn logs an event at slog.LevelWarn.
+func (l *Logger) Warn(msg string, fields ...map[string]interface{}) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+// Error logs an event at slog.LevelError.
+func (l *Logger) Error(msg string, fields ...map[string]interface{}) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *Logger) log(level slog.Level, msg string, fields []map[string]interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	var attrs []slog.Attr
+	for _, f := range fields {
+		// Sort the keys for consistent output
+		keys := make([]string, 0, len(f))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			attrs = append(attrs, slog.Any(k, f[k]))
+		}
+	}
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,68 @@
+//go:build go1.21
+// +build go1.21
+
+package slog_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johanbrandhorst/certify"
+	certifyslog "github.com/johanbrandhorst/certify/logging/slog"
+)
+
+var _ certify.Logger = (*certifyslog.Logger)(nil)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: certifyslog.LevelTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	l := certifyslog.New(slog.New(h))
+
+	l.Trace("trace")
+	l.Info("New certificate issued", map[string]interface{}{
+		certify.LogFieldSerial:   "123456",
+		certify.LogFieldName:     "example.com",
+		certify.LogFieldDuration: time.Second,
+	})
+	l.Error("failed", map[string]interface{}{
+		certify.LogFieldError: "sealed",
+	}, map[string]interface{}{
+		certify.LogFieldAttempt: 2,
+	})
+
+	want := []string{
+		`level=DEBUG-4 msg=trace`,
+		`level=INFO msg="New certificate issued" duration=1s name=example.com serial=123456`,
+		`level=ERROR msg=failed error=sealed attempt=2`,
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(got), len(want), buf.String())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d:\ngot  %s\nwant %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := certifyslog.New(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	l.Debug("hidden", map[string]interface{}{certify.LogFieldName: "example.com"})
+	if buf.Len() != 0 {
+		t.Errorf("expected no output below the handler level, got %q", buf.String())
+	}
+}
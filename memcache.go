@@ -0,0 +1,202 @@
+package certify
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// How often Put checks all entries for expired
+// certificates, when MemCacheEvictExpired is used.
+const memCacheSweepInterval = time.Minute
+
+// MemCacheOption configures a cache created by NewMemCache.
+type MemCacheOption func(*memCache)
+
+// MemCacheMaxEntries limits the number of certificates stored
+// in the cache. Once the limit is reached, storing a certificate
+// evicts the least recently used certificate. Defaults to no limit.
+func MemCacheMaxEntries(n int) MemCacheOption {
+	return func(m *memCache) {
+		m.maxEntries = n
+	}
+}
+
+// MemCacheEvictExpired evicts certificates from the cache once they
+// have expired. Expired certificates are reported as cache misses,
+// and are periodically removed when certificates are stored.
+func MemCacheEvictExpired() MemCacheOption {
+	return func(m *memCache) {
+		m.evictExpired = true
+	}
+}
+
+// MemCacheStats are statistics of a cache created by NewMemCache.
+type MemCacheStats struct {
+	// Entries is the number of certificates in the cache.
+	Entries int
+	// Evictions is the number of certificates evicted
+	// to keep the cache within MemCacheMaxEntries.
+	Evictions uint64
+	// Expirations is the number of certificates
+	// evicted by MemCacheEvictExpired.
+	Expirations uint64
+}
+
+// MemCacheStatsOf returns the statistics of a cache created by NewMemCache.
+// It returns false if the cache was not created by NewMemCache.
+func MemCacheStatsOf(c Cache) (MemCacheStats, bool) {
+	m, ok := c.(*memCache)
+	if !ok {
+		return MemCacheStats{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.stats
+	stats.Entries = len(m.entries)
+	return stats, true
+}
+
+type memCache struct {
+	maxEntries   int
+	evictExpired bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru orders the entries from the most
+	// to the least recently used.
+	lru       *list.List
+	lastSweep time.Time
+	stats     MemCacheStats
+}
+
+type memCacheEntry struct {
+	key  string
+	cert *tls.Certificate
+	// notAfter is the zero time if the
+	// certificate couldn't be parsed.
+	notAfter time.Time
+}
+
+// NewMemCache creates an in-memory cache that implements the Cache interface.
+// By default, the cache stores certificates until they are deleted, which
+// can use a lot of memory for services that serve any server name. Use
+// MemCacheMaxEntries and MemCacheEvictExpired to bound the cache, and
+// MemCacheStatsOf to monitor evictions.
+func NewMemCache(opts ...MemCacheOption) Cache {
+	m := &memCache{
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *memCache) Get(_ context.Context, key string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := elem.Value.(*memCacheEntry)
+	if m.expired(entry, time.Now()) {
+		m.remove(elem)
+		m.stats.Expirations++
+		return nil, ErrCacheMiss
+	}
+
+	m.lru.MoveToFront(elem)
+	return entry.cert, nil
+}
+
+func (m *memCache) Put(_ context.Context, key string, cert *tls.Certificate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &memCacheEntry{
+		key:  key,
+		cert: cert,
+	}
+	if leaf := cert.Leaf; leaf != nil {
+		entry.notAfter = leaf.NotAfter
+	} else if len(cert.Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			entry.notAfter = leaf.NotAfter
+		}
+	}
+
+	if elem, ok := m.entries[key]; ok {
+		elem.Value = entry
+		m.lru.MoveToFront(elem)
+	} else {
+		m.entries[key] = m.lru.PushFront(entry)
+	}
+
+	now := time.Now()
+	if m.evictExpired && now.Sub(m.lastSweep) > memCacheSweepInterval {
+		m.lastSweep = now
+		for elem := m.lru.Front(); elem != nil; {
+			next := elem.Next()
+			if m.expired(elem.Value.(*memCacheEntry), now) {
+				m.remove(elem)
+				m.stats.Expirations++
+			}
+			elem = next
+		}
+	}
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back())
+		m.stats.Evictions++
+	}
+
+	return nil
+}
+
+func (m *memCache) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		m.remove(elem)
+	}
+	return nil
+}
+
+func (m *memCache) List(context.Context) ([]CacheEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]CacheEntry, 0, len(m.entries))
+	for key, elem := range m.entries {
+		entry := elem.Value.(*memCacheEntry)
+		if m.expired(entry, now) {
+			continue
+		}
+		if ce, ok := newCacheEntry(key, entry.cert); ok {
+			entries = append(entries, ce)
+		}
+	}
+	sortEntries(entries)
+
+	return entries, nil
+}
+
+// expired reports whether the entry should be evicted as expired.
+func (m *memCache) expired(entry *memCacheEntry, now time.Time) bool {
+	return m.evictExpired && !entry.notAfter.IsZero() && now.After(entry.notAfter)
+}
+
+func (m *memCache) remove(elem *list.Element) {
+	m.lru.Remove(elem)
+	delete(m.entries, elem.Value.(*memCacheEntry).key)
+}
@@ -0,0 +1,82 @@
+package certify_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+var _ = Describe("MemCache", func() {
+	var cert *tls.Certificate
+
+	BeforeEach(func() {
+		var err error
+		cert, err = generateCertAndKey("localhost", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+	})
+
+	It("evicts the least recently used certificates", func() {
+		cache := certify.NewMemCache(certify.MemCacheMaxEntries(2))
+		Expect(cache.Put(context.Background(), "key1", cert)).To(Succeed())
+		Expect(cache.Put(context.Background(), "key2", cert)).To(Succeed())
+		_, err := cache.Get(context.Background(), "key1")
+		Expect(err).To(Succeed())
+		// Replacing a certificate doesn't evict any
+		Expect(cache.Put(context.Background(), "key2", cert)).To(Succeed())
+		Expect(cache.Put(context.Background(), "key3", cert)).To(Succeed())
+
+		_, err = cache.Get(context.Background(), "key1")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+		_, err = cache.Get(context.Background(), "key2")
+		Expect(err).To(Succeed())
+		_, err = cache.Get(context.Background(), "key3")
+		Expect(err).To(Succeed())
+
+		stats, ok := certify.MemCacheStatsOf(cache)
+		Expect(ok).To(BeTrue())
+		Expect(stats).To(Equal(certify.MemCacheStats{Entries: 2, Evictions: 1}))
+	})
+
+	It("evicts expired certificates", func() {
+		expired, err := generateExpiredCert()
+		Expect(err).To(Succeed())
+		cache := certify.NewMemCache(certify.MemCacheEvictExpired())
+		Expect(cache.Put(context.Background(), "expired1", expired)).To(Succeed())
+		Expect(cache.Put(context.Background(), "expired2", expired)).To(Succeed())
+		Expect(cache.Put(context.Background(), "valid", cert)).To(Succeed())
+
+		// Removed when first stored, then when read
+		stats, _ := certify.MemCacheStatsOf(cache)
+		Expect(stats).To(Equal(certify.MemCacheStats{Entries: 2, Expirations: 1}))
+		Expect(cache.(certify.ListableCache).List(context.Background())).To(HaveLen(1))
+		_, err = cache.Get(context.Background(), "expired2")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+		_, err = cache.Get(context.Background(), "valid")
+		Expect(err).To(Succeed())
+
+		stats, _ = certify.MemCacheStatsOf(cache)
+		Expect(stats).To(Equal(certify.MemCacheStats{Entries: 1, Expirations: 2}))
+	})
+
+	It("keeps expired certificates by default", func() {
+		expired, err := generateExpiredCert()
+		Expect(err).To(Succeed())
+		cache := certify.NewMemCache()
+		Expect(cache.Put(context.Background(), "expired", expired)).To(Succeed())
+		Expect(cache.Get(context.Background(), "expired")).To(Equal(expired))
+
+		_, ok := certify.MemCacheStatsOf(certify.DirCache(""))
+		Expect(ok).To(BeFalse())
+	})
+})
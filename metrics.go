@@ -0,0 +1,64 @@
+package certify
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cache operations recorded by Metrics.
+const (
+	CacheOpGet    = "get"
+	CacheOpPut    = "put"
+	CacheOpDelete = "delete"
+)
+
+// Cache operation results recorded by Metrics.
+const (
+	CacheResultHit     = "hit"
+	CacheResultMiss    = "miss"
+	CacheResultSuccess = "success"
+	CacheResultError   = "error"
+)
+
+// Metrics must be implemented to record metrics of the
+// operations of Certify. See the metrics/prometheus package
+// for an implementation using Prometheus.
+type Metrics interface {
+	// ObserveIssue records a request to the Issuer,
+	// how long it took and whether it failed.
+	ObserveIssue(issuer string, duration time.Duration, err error)
+	// ObserveCache records a Cache operation, one of CacheOpGet,
+	// CacheOpPut and CacheOpDelete, and its result, one of
+	// CacheResultHit and CacheResultMiss for CacheOpGet,
+	// CacheResultSuccess, or CacheResultError.
+	ObserveCache(op, result string)
+	// ObserveIssueCollapsed records a request for a certificate
+	// that was de-duplicated with a simultaneous request
+	// for the same certificate.
+	ObserveIssueCollapsed()
+	// SetCertExpiry records the expiry of the certificate
+	// currently in use for the cache key.
+	SetCertExpiry(key string, notAfter time.Time)
+	// DeleteCertExpiry stops recording the expiry of the certificate
+	// for the cache key, once it has been deleted from the cache.
+	// Certificates can also be evicted by the cache itself, so
+	// implementations should stop recording expired certificates.
+	DeleteCertExpiry(key string)
+}
+
+type noopMetrics struct{}
+
+func (*noopMetrics) ObserveIssue(string, time.Duration, error) {}
+func (*noopMetrics) ObserveCache(string, string)               {}
+func (*noopMetrics) ObserveIssueCollapsed()                    {}
+func (*noopMetrics) SetCertExpiry(string, time.Time)           {}
+func (*noopMetrics) DeleteCertExpiry(string)                   {}
+
+// issuerName returns the name used to identify the issuer in
+// metrics and logs: the name of a NamedIssuer, or its type.
+func issuerName(iss Issuer) string {
+	if n, ok := iss.(*NamedIssuer); ok && n.Name != "" {
+		return n.Name
+	}
+	return fmt.Sprintf("%T", iss)
+}
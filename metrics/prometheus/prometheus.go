@@ -0,0 +1,130 @@
+// Package prometheus implements certify.Metrics using Prometheus collectors.
+package prometheus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+// Metrics implements certify.Metrics and prometheus.Collector.
+// Register it with a prometheus.Registerer to expose the metrics.
+//
+// Use New to create a Metrics.
+type Metrics struct {
+	issueDuration  *prometheus.HistogramVec
+	cacheOps       *prometheus.CounterVec
+	issueCollapsed prometheus.Counter
+	expiryDesc     *prometheus.Desc
+
+	mu     sync.Mutex
+	expiry map[string]time.Time
+}
+
+// Ensure Metrics implements both interfaces.
+var (
+	_ certify.Metrics      = (*Metrics)(nil)
+	_ prometheus.Collector = (*Metrics)(nil)
+)
+
+// New creates a new Metrics. All metric names are
+// prefixed with the namespace, if not empty.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		issueDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "certify",
+			Name:      "issue_duration_seconds",
+			Help:      "Latency of certificate requests to the issuer.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"issuer", "outcome"}),
+		cacheOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "certify",
+			Name:      "cache_operations_total",
+			Help:      "Number of cache operations, by operation and result.",
+		}, []string{"op", "result"}),
+		issueCollapsed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "certify",
+			Name:      "issue_collapsed_total",
+			Help:      "Number of certificate requests de-duplicated with a simultaneous request.",
+		}),
+		expiryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "certify", "certificate_expiry_seconds"),
+			"Seconds until the expiry of the certificate in use, by cache key.",
+			[]string{"key"},
+			nil,
+		),
+		expiry: map[string]time.Time{},
+	}
+}
+
+// ObserveIssue implements certify.Metrics.
+func (m *Metrics) ObserveIssue(issuer string, duration time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.issueDuration.WithLabelValues(issuer, outcome).Observe(duration.Seconds())
+}
+
+// ObserveCache implements certify.Metrics.
+func (m *Metrics) ObserveCache(op, result string) {
+	m.cacheOps.WithLabelValues(op, result).Inc()
+}
+
+// ObserveIssueCollapsed implements certify.Metrics.
+func (m *Metrics) ObserveIssueCollapsed() {
+	m.issueCollapsed.Inc()
+}
+
+// SetCertExpiry implements certify.Metrics.
+func (m *Metrics) SetCertExpiry(key string, notAfter time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiry[key] = notAfter
+}
+
+// DeleteCertExpiry implements certify.Metrics.
+func (m *Metrics) DeleteCertExpiry(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.expiry, key)
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.issueDuration.Describe(ch)
+	m.cacheOps.Describe(ch)
+	m.issueCollapsed.Describe(ch)
+	ch <- m.expiryDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.issueDuration.Collect(ch)
+	m.cacheOps.Collect(ch)
+	m.issueCollapsed.Collect(ch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, notAfter := range m.expiry {
+		if now.After(notAfter) {
+			// No longer in use, and may have been
+			// evicted from the cache without a trace
+			delete(m.expiry, key)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			m.expiryDesc,
+			prometheus.GaugeValue,
+			notAfter.Sub(now).Seconds(),
+			key,
+		)
+	}
+}
@@ -0,0 +1,76 @@
+package prometheus_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/johanbrandhorst/certify"
+	certifyprom "github.com/johanbrandhorst/certify/metrics/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	m := certifyprom.New("test")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatal(err)
+	}
+
+	m.ObserveIssue("*vault.Issuer", time.Second, nil)
+	m.ObserveIssue("*vault.Issuer", time.Second, errors.New("test"))
+	m.ObserveCache(certify.CacheOpGet, certify.CacheResultHit)
+	m.ObserveCache(certify.CacheOpGet, certify.CacheResultMiss)
+	m.ObserveCache(certify.CacheOpGet, certify.CacheResultMiss)
+	m.ObserveIssueCollapsed()
+
+	expected := `
+# HELP test_certify_cache_operations_total Number of cache operations, by operation and result.
+# TYPE test_certify_cache_operations_total counter
+test_certify_cache_operations_total{op="get",result="hit"} 1
+test_certify_cache_operations_total{op="get",result="miss"} 2
+# HELP test_certify_issue_collapsed_total Number of certificate requests de-duplicated with a simultaneous request.
+# TYPE test_certify_issue_collapsed_total counter
+test_certify_issue_collapsed_total 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"test_certify_cache_operations_total",
+		"test_certify_issue_collapsed_total",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(m, "test_certify_issue_duration_seconds"); n != 2 {
+		t.Fatalf("Unexpected number of issue duration series %d, wanted 2", n)
+	}
+
+	m.SetCertExpiry("example.com", time.Now().Add(time.Hour))
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "test_certify_certificate_expiry_seconds" {
+			continue
+		}
+		found = true
+		v := mf.GetMetric()[0].GetGauge().GetValue()
+		if v <= 0 || v > time.Hour.Seconds() {
+			t.Fatalf("Unexpected expiry %f, wanted within the next hour", v)
+		}
+	}
+	if !found {
+		t.Fatal("Expiry metric not found")
+	}
+
+	m.DeleteCertExpiry("example.com")
+	m.SetCertExpiry("expired.com", time.Now().Add(-time.Minute))
+	if n := testutil.CollectAndCount(m, "test_certify_certificate_expiry_seconds"); n != 0 {
+		t.Fatalf("Unexpected number of expiry series %d, wanted deleted and expired certificates to be dropped", n)
+	}
+}
@@ -0,0 +1,320 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johanbrandhorst/certify/internal/logging"
+)
+
+// IssueStrategy configures how a MultiIssuer distributes
+// requests between its issuers.
+type IssueStrategy int
+
+// Supported issue strategies
+const (
+	// Failover sends requests to the issuers in order,
+	// moving on to the next issuer if one fails.
+	Failover IssueStrategy = iota
+	// RoundRobin rotates the first issuer tried between
+	// requests, moving on to the next issuer if one fails.
+	RoundRobin
+	// Hedged sends requests to the issuers in order, starting
+	// a request against the next issuer if the previous one has
+	// failed or has not responded within the HedgeDelay.
+	// The first successfully issued certificate is returned.
+	Hedged
+)
+
+const (
+	defaultHedgeDelay       = 5 * time.Second
+	defaultFailureThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// MultiIssuer implements the Issuer interface by distributing
+// requests between several issuers, for example two Vault clusters,
+// or Vault with CFSSL as a fallback.
+//
+// Each issuer has a circuit breaker which, after FailureThreshold
+// consecutive failures, causes the issuer to be skipped until
+// BreakerCooldown has passed. After that, a single request is allowed
+// through to probe the issuer. If the breakers of all issuers are open,
+// all issuers are tried regardless.
+//
+// Issuers is required.
+type MultiIssuer struct {
+	// Issuers are the issuers requests are distributed between.
+	Issuers []Issuer
+
+	// Strategy configures how requests are distributed
+	// between the issuers. Defaults to Failover.
+	Strategy IssueStrategy
+
+	// HedgeDelay configures how long to wait for an issuer
+	// to respond before sending the request to the next issuer
+	// when using the Hedged strategy. Defaults to 5 seconds.
+	HedgeDelay time.Duration
+
+	// FailureThreshold configures the number of consecutive
+	// failures after which an issuer is skipped. Defaults to 5.
+	FailureThreshold int
+
+	// BreakerCooldown configures how long an issuer is skipped
+	// for once it has reached the FailureThreshold.
+	// Defaults to 30 seconds.
+	BreakerCooldown time.Duration
+
+	// Logger configures logging of failed requests
+	// and circuit breaker state. Defaults to no logging.
+	Logger Logger
+
+	// Metrics configures recording of the outcome of requests to
+	// each of the issuers. Use NamedIssuer to tell issuers of
+	// the same type apart. Defaults to no metrics.
+	Metrics Metrics
+
+	initOnce sync.Once
+	logger   logging.Logger
+	metrics  Metrics
+	breakers []*breaker
+	next     uint32
+}
+
+func (m *MultiIssuer) init() {
+	if m.HedgeDelay <= 0 {
+		m.HedgeDelay = defaultHedgeDelay
+	}
+	if m.FailureThreshold <= 0 {
+		m.FailureThreshold = defaultFailureThreshold
+	}
+	if m.BreakerCooldown <= 0 {
+		m.BreakerCooldown = defaultBreakerCooldown
+	}
+	m.logger = logging.OrNoop(m.Logger)
+	m.metrics = m.Metrics
+	if m.metrics == nil {
+		m.metrics = &noopMetrics{}
+	}
+	m.breakers = make([]*breaker, len(m.Issuers))
+	for i := range m.breakers {
+		m.breakers[i] = &breaker{
+			threshold: m.FailureThreshold,
+			cooldown:  m.BreakerCooldown,
+		}
+	}
+}
+
+// Issue issues a certificate from one of the configured issuers,
+// according to the configured Strategy.
+func (m *MultiIssuer) Issue(ctx context.Context, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	m.initOnce.Do(m.init)
+	if len(m.Issuers) == 0 {
+		return nil, errors.New("no issuers configured")
+	}
+
+	order := make([]int, len(m.Issuers))
+	start := 0
+	if m.Strategy == RoundRobin {
+		start = int((atomic.AddUint32(&m.next, 1) - 1) % uint32(len(m.Issuers)))
+	}
+	for i := range order {
+		order[i] = (start + i) % len(m.Issuers)
+	}
+
+	if m.Strategy == Hedged {
+		return m.issueHedged(ctx, order, commonName, conf)
+	}
+	return m.issueInOrder(ctx, order, commonName, conf)
+}
+
+func (m *MultiIssuer) issueInOrder(ctx context.Context, order []int, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	var (
+		err   error
+		tried bool
+	)
+	for _, idx := range order {
+		if !m.breakers[idx].allow(time.Now()) {
+			continue
+		}
+		tried = true
+		var cert *tls.Certificate
+		cert, err = m.issue(ctx, idx, commonName, conf)
+		if err == nil {
+			return cert, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	if !tried {
+		// All breakers are open, try all issuers anyway
+		m.logger.Warn("All issuer circuit breakers are open, trying all issuers", map[string]interface{}{
+			LogFieldName: commonName,
+		})
+		for _, idx := range order {
+			var cert *tls.Certificate
+			cert, err = m.issue(ctx, idx, commonName, conf)
+			if err == nil {
+				return cert, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("all issuers failed, last error: %w", err)
+}
+
+func (m *MultiIssuer) issueHedged(ctx context.Context, order []int, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Cancel any outstanding requests once we're done
+	defer cancel()
+
+	// Skip issuers with open breakers, unless all are open
+	var allowed []int
+	for _, idx := range order {
+		if m.breakers[idx].allow(time.Now()) {
+			allowed = append(allowed, idx)
+		}
+	}
+	if len(allowed) == 0 {
+		m.logger.Warn("All issuer circuit breakers are open, trying all issuers", map[string]interface{}{
+			LogFieldName: commonName,
+		})
+		allowed = order
+	}
+
+	type result struct {
+		cert *tls.Certificate
+		err  error
+	}
+	results := make(chan result, len(allowed))
+	launch := func(idx int) {
+		go func() {
+			cert, err := m.issue(ctx, idx, commonName, conf)
+			results <- result{cert: cert, err: err}
+		}()
+	}
+
+	launch(allowed[0])
+	launched, pending := 1, 1
+	timer := time.NewTimer(m.HedgeDelay)
+	defer timer.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			if launched < len(allowed) {
+				launch(allowed[launched])
+				launched++
+				pending++
+				timer.Reset(m.HedgeDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.cert, nil
+			}
+			err = res.err
+			// Start the next issuer immediately on failure
+			if launched < len(allowed) {
+				launch(allowed[launched])
+				launched++
+				pending++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(m.HedgeDelay)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("all issuers failed, last error: %w", err)
+}
+
+// issue issues a certificate from the issuer at idx,
+// recording the outcome in its circuit breaker.
+func (m *MultiIssuer) issue(ctx context.Context, idx int, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	start := time.Now()
+	cert, err := m.Issuers[idx].Issue(ctx, commonName, conf)
+	// Don't penalize the issuer for requests we canceled
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	dur := time.Since(start)
+	m.metrics.ObserveIssue(issuerName(m.Issuers[idx]), dur, err)
+	if m.breakers[idx].record(err, time.Now()) {
+		m.logger.Warn("Issuer circuit breaker opened", map[string]interface{}{
+			LogFieldIssuer: issuerName(m.Issuers[idx]),
+			"cooldown":     m.BreakerCooldown,
+		})
+	}
+	if err != nil {
+		m.logger.Warn("Issuer failed to issue certificate", map[string]interface{}{
+			LogFieldName:     commonName,
+			LogFieldIssuer:   issuerName(m.Issuers[idx]),
+			LogFieldDuration: dur,
+			LogFieldError:    err.Error(),
+		})
+	}
+	return cert, err
+}
+
+// breaker is a consecutive failure circuit breaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a request may be sent. Once the cooldown
+// of an open breaker has passed, a single request is allowed
+// per cooldown period.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// record records the outcome of a request, reporting
+// whether it caused the breaker to open.
+func (b *breaker) record(err error, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+		return true
+	}
+	return false
+}
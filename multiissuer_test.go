@@ -0,0 +1,164 @@
+package certify_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/mocks"
+)
+
+var _ = Describe("MultiIssuer", func() {
+	issuerWithSerial := func(serial int64) *mocks.IssuerMock {
+		return &mocks.IssuerMock{
+			IssueFunc: func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+				return &tls.Certificate{
+					Leaf: &x509.Certificate{
+						SerialNumber: big.NewInt(serial),
+						NotAfter:     time.Now().Add(time.Hour),
+					},
+				}, nil
+			},
+		}
+	}
+	failingIssuer := func() *mocks.IssuerMock {
+		return &mocks.IssuerMock{
+			IssueFunc: func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+				return nil, errors.New("issuer unavailable")
+			},
+		}
+	}
+
+	Context("when using the Failover strategy", func() {
+		It("moves on to the next issuer on failure", func() {
+			first, second := failingIssuer(), issuerWithSerial(2)
+			m := &certify.MultiIssuer{
+				Issuers: []certify.Issuer{first, second},
+			}
+
+			cert, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(2))
+			Expect(first.IssueCalls()).To(HaveLen(1))
+			Expect(second.IssueCalls()).To(HaveLen(1))
+		})
+
+		It("returns an error if all issuers fail", func() {
+			m := &certify.MultiIssuer{
+				Issuers: []certify.Issuer{failingIssuer(), failingIssuer()},
+			}
+
+			_, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(MatchError(ContainSubstring("issuer unavailable")))
+		})
+
+		It("skips issuers with open circuit breakers", func() {
+			first, second := failingIssuer(), issuerWithSerial(2)
+			m := &certify.MultiIssuer{
+				Issuers:          []certify.Issuer{first, second},
+				FailureThreshold: 2,
+				BreakerCooldown:  time.Hour,
+			}
+
+			for i := 0; i < 4; i++ {
+				_, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+				Expect(err).To(Succeed())
+			}
+			Expect(first.IssueCalls()).To(HaveLen(2))
+			Expect(second.IssueCalls()).To(HaveLen(4))
+		})
+
+		It("tries all issuers if all circuit breakers are open", func() {
+			first, second := failingIssuer(), failingIssuer()
+			m := &certify.MultiIssuer{
+				Issuers:          []certify.Issuer{first, second},
+				FailureThreshold: 1,
+				BreakerCooldown:  time.Hour,
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+				Expect(err).NotTo(Succeed())
+			}
+			Expect(first.IssueCalls()).To(HaveLen(2))
+			Expect(second.IssueCalls()).To(HaveLen(2))
+		})
+	})
+
+	Context("when using the RoundRobin strategy", func() {
+		It("rotates between the issuers", func() {
+			first, second := issuerWithSerial(1), issuerWithSerial(2)
+			m := &certify.MultiIssuer{
+				Issuers:  []certify.Issuer{first, second},
+				Strategy: certify.RoundRobin,
+			}
+
+			for i := 0; i < 4; i++ {
+				cert, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+				Expect(err).To(Succeed())
+				Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(i%2 + 1))
+			}
+			Expect(first.IssueCalls()).To(HaveLen(2))
+			Expect(second.IssueCalls()).To(HaveLen(2))
+		})
+	})
+
+	Context("when using the Hedged strategy", func() {
+		It("returns the first successful response", func() {
+			slow := &mocks.IssuerMock{
+				IssueFunc: func(ctx context.Context, _ string, _ *certify.CertConfig) (*tls.Certificate, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				},
+			}
+			fast := issuerWithSerial(2)
+			m := &certify.MultiIssuer{
+				Issuers:    []certify.Issuer{slow, fast},
+				Strategy:   certify.Hedged,
+				HedgeDelay: 10 * time.Millisecond,
+			}
+
+			cert, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(2))
+			Eventually(slow.IssueCalls).Should(HaveLen(1))
+		})
+
+		It("starts the next issuer immediately on failure", func() {
+			second := issuerWithSerial(2)
+			m := &certify.MultiIssuer{
+				Issuers:    []certify.Issuer{failingIssuer(), second},
+				Strategy:   certify.Hedged,
+				HedgeDelay: time.Hour,
+			}
+
+			cert, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+			Expect(cert.Leaf.SerialNumber.Int64()).To(BeEquivalentTo(2))
+		})
+	})
+
+	Context("when Metrics are configured", func() {
+		It("records the outcome of requests to each issuer", func() {
+			metrics := &recordingMetrics{expiry: map[string]time.Time{}}
+			m := &certify.MultiIssuer{
+				Issuers: []certify.Issuer{
+					&certify.NamedIssuer{Name: "vault-eu", Issuer: failingIssuer()},
+					&certify.NamedIssuer{Name: "vault-us", Issuer: issuerWithSerial(2)},
+				},
+				Metrics: metrics,
+			}
+
+			_, err := m.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+			Expect(err).To(Succeed())
+			Expect(metrics.issues).To(Equal([]string{"vault-eu", "vault-us"}))
+		})
+	})
+})
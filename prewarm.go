@@ -0,0 +1,171 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/johanbrandhorst/certify/internal/tracing"
+)
+
+const defaultPrewarmConcurrency = 4
+
+// PrewarmResult is the outcome of prewarming
+// the certificate for a name.
+type PrewarmResult struct {
+	// Name is the name the certificate was prewarmed for.
+	Name string
+	// Certificate is the certificate loaded from the cache
+	// or issued for the name. If Variants are configured,
+	// it is the certificate of the first variant.
+	Certificate *tls.Certificate
+	// Err is the error prewarming the certificate, if any.
+	Err error
+}
+
+// Prewarm loads the certificates that would be served for the server
+// names and the client certificate for the CommonName from the cache,
+// issuing any that are missing or due for renewal. It can be called
+// at startup to avoid issuing certificates during the first handshakes.
+//
+// The names are subject to the HostPolicy, Wildcards and Batch as
+// in GetCertificate, and names sharing a certificate are only
+// loaded once. If Variants are configured, all variants are prewarmed.
+// Up to PrewarmConcurrency certificates are loaded or issued at once.
+//
+// The returned results are in the order of the names, preceded by
+// the result for the CommonName. Prewarm returns once all
+// certificates have been loaded or issued, or the context is done.
+func (c *Certify) Prewarm(ctx context.Context, names ...string) []PrewarmResult {
+	c.initOnce.Do(c.init)
+	ctx, span := c.tracer.Start(ctx, "certify.Prewarm", trace.WithAttributes(
+		attribute.StringSlice("certify.names", names),
+	))
+	defer span.End()
+
+	results := make([]PrewarmResult, len(names)+1)
+	// The index of the request of each result, or -1 if it failed already
+	reqIdx := make([]int, len(names)+1)
+	var reqs []certRequest
+	keys := map[string]int{}
+	addRequest := func(i int, req certRequest) {
+		idx, ok := keys[req.key]
+		if !ok {
+			idx = len(reqs)
+			keys[req.key] = idx
+			reqs = append(reqs, req)
+		}
+		reqIdx[i] = idx
+	}
+
+	results[0].Name = c.CommonName
+	addRequest(0, c.clientRequest())
+
+	var (
+		batched      []int
+		batchedNames []string
+	)
+	for i, n := range names {
+		i++
+		results[i].Name = n
+		reqIdx[i] = -1
+		name, err := serverName(n)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if c.HostPolicy != nil {
+			if err := c.HostPolicy(ctx, name); err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		name = c.wildcardFor(name)
+		if c.batch != nil && c.batch.add(name) {
+			// Build the request once all names have been added
+			batched = append(batched, i)
+			batchedNames = append(batchedNames, name)
+			continue
+		}
+		addRequest(i, nameRequest(name))
+	}
+	if len(batched) > 0 {
+		req := c.batch.request(c.CommonName, batchedNames...)
+		for _, i := range batched {
+			addRequest(i, req)
+		}
+	}
+
+	concurrency := c.PrewarmConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrewarmConcurrency
+	}
+	certs := make([]*tls.Certificate, len(reqs))
+	errs := make([]error, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int, req certRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			certs[i], errs[i] = c.prewarm(ctx, req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range results {
+		if reqIdx[i] >= 0 {
+			results[i].Certificate = certs[reqIdx[i]]
+			results[i].Err = errs[reqIdx[i]]
+		}
+		if results[i].Err != nil {
+			failed++
+			c.Logger.Error("Failed to prewarm certificate", map[string]interface{}{
+				LogFieldName:  results[i].Name,
+				LogFieldError: results[i].Err.Error(),
+			})
+		}
+	}
+	c.Logger.Debug("Prewarmed certificates", map[string]interface{}{
+		"certificates": len(reqs),
+		"failed":       failed,
+	})
+
+	return results
+}
+
+// prewarm loads or issues the certificates of all variants
+// of the request, returning the certificate of the first variant.
+func (c *Certify) prewarm(ctx context.Context, req certRequest) (cert *tls.Certificate, err error) {
+	ctx, span := c.tracer.Start(ctx, "certify.Prewarm.certificate", trace.WithAttributes(
+		attribute.String("certify.key", req.key),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	if len(c.Variants) == 0 {
+		return c.getOrRenewCert(ctx, req)
+	}
+	for i, v := range c.Variants {
+		vCert, vErr := c.getOrRenewCert(ctx, req.variant(v))
+		if vErr != nil && err == nil {
+			err = vErr
+		}
+		if i == 0 {
+			cert = vCert
+		}
+	}
+	return cert, err
+}
@@ -0,0 +1,196 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/johanbrandhorst/certify/internal/logging"
+)
+
+// RetryableError wraps errors returned from an Issuer that are
+// expected to be resolved by retrying the request, such as
+// temporary network problems or throttling.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError wraps errors returned from an Issuer that
+// will not be resolved by retrying the request, such as
+// invalid requests or authorization failures.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether an error returned from an Issuer
+// should be retried. Errors wrapping a RetryableError, a net.Error
+// that timed out or a reset connection are considered retryable,
+// unless they also wrap a PermanentError. Context errors and all
+// other errors, such as refused connections or failures to verify
+// the certificate of the server, are not considered retryable.
+func IsRetryable(err error) bool {
+	var permErr *PermanentError
+	if err == nil || errors.As(err, &permErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var retryErr *RetryableError
+	if errors.As(err, &retryErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 10 * time.Second
+	defaultRetryMultiplier     = 2
+)
+
+// RetryIssuer implements the Issuer interface by wrapping
+// another Issuer, retrying failed requests with exponential backoff.
+// The issuers in this repository return RetryableError and
+// PermanentError to classify their errors.
+// Retries are bounded by the context of the request, so
+// the IssueTimeout of Certify bounds the total time spent.
+//
+// Issuer is required.
+type RetryIssuer struct {
+	// Issuer is the Issuer to retry requests against.
+	Issuer Issuer
+
+	// MaxAttempts is the maximum number of attempts
+	// per request, including the first. Defaults to 3.
+	MaxAttempts int
+
+	// InitialBackoff is the time to wait before the
+	// first retry. Defaults to 500 milliseconds.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the upper bound of the time
+	// to wait between attempts. Defaults to 10 seconds.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor the backoff is
+	// multiplied by after each attempt. Defaults to 2.
+	Multiplier float64
+
+	// Jitter is the fraction, between 0 and 1, by which
+	// each backoff is randomly adjusted up or down, to avoid
+	// synchronized retries. Defaults to no jitter.
+	Jitter float64
+
+	// IsRetryable classifies errors returned from the Issuer.
+	// Defaults to IsRetryable.
+	IsRetryable func(error) bool
+
+	// Logger configures logging of failed attempts.
+	// Defaults to no logging.
+	Logger Logger
+}
+
+// Issue issues a certificate from the wrapped Issuer,
+// retrying retryable errors.
+func (r *RetryIssuer) Issue(ctx context.Context, commonName string, conf *CertConfig) (*tls.Certificate, error) {
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	isRetryable := r.IsRetryable
+	if isRetryable == nil {
+		isRetryable = IsRetryable
+	}
+
+	logger := logging.OrNoop(r.Logger)
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		cert, err := r.Issuer.Issue(ctx, commonName, conf)
+		if err == nil {
+			return cert, nil
+		}
+		fields := map[string]interface{}{
+			LogFieldName:     commonName,
+			LogFieldIssuer:   issuerName(r.Issuer),
+			LogFieldAttempt:  attempt,
+			LogFieldDuration: time.Since(start),
+			LogFieldError:    err.Error(),
+		}
+		if attempt >= maxAttempts || !isRetryable(err) {
+			logger.Debug("Certificate request failed, not retrying", fields)
+			return nil, err
+		}
+
+		backoff := r.backoff(attempt)
+		fields["backoff"] = backoff
+		logger.Warn("Certificate request failed, retrying", fields)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			// Return the issuer error rather than the context error,
+			// it is more useful to the caller.
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns the time to wait after the attempt.
+func (r *RetryIssuer) backoff(attempt int) time.Duration {
+	initial := r.InitialBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	maxBackoff := r.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	multiplier := r.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultRetryMultiplier
+	}
+
+	backoff := float64(initial)
+	for i := 1; i < attempt && backoff < float64(maxBackoff); i++ {
+		backoff *= multiplier
+	}
+	if backoff > float64(maxBackoff) {
+		backoff = float64(maxBackoff)
+	}
+	if jitter := math.Min(r.Jitter, 1); jitter > 0 {
+		backoff += backoff * jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(backoff)
+}
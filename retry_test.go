@@ -0,0 +1,132 @@
+package certify_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+	"github.com/johanbrandhorst/certify/mocks"
+)
+
+var _ = Describe("RetryIssuer", func() {
+	failingThenSucceeding := func(failures int, err error) *mocks.IssuerMock {
+		issuer := &mocks.IssuerMock{}
+		issuer.IssueFunc = func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+			if len(issuer.IssueCalls()) <= failures {
+				return nil, err
+			}
+			return &tls.Certificate{
+				Leaf: &x509.Certificate{
+					SerialNumber: big.NewInt(123456),
+					NotAfter:     time.Now().Add(time.Hour),
+				},
+			}, nil
+		}
+		return issuer
+	}
+
+	It("retries retryable errors", func() {
+		issuer := failingThenSucceeding(2, &certify.RetryableError{Err: errors.New("sealed")})
+		logger := &mocks.LoggerMock{
+			WarnFunc: func(string, ...map[string]interface{}) {},
+		}
+		r := &certify.RetryIssuer{
+			Issuer:         issuer,
+			InitialBackoff: time.Millisecond,
+			Jitter:         0.5,
+			Logger:         logger,
+		}
+
+		_, err := r.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+		Expect(err).To(Succeed())
+		Expect(issuer.IssueCalls()).To(HaveLen(3))
+		Expect(logger.WarnCalls()).To(HaveLen(2))
+		for i, call := range logger.WarnCalls() {
+			Expect(call.Fields[0]).To(HaveKeyWithValue(certify.LogFieldAttempt, i+1))
+			Expect(call.Fields[0]).To(HaveKeyWithValue(certify.LogFieldName, "myserver.com"))
+			Expect(call.Fields[0]).To(HaveKeyWithValue(certify.LogFieldError, "sealed"))
+		}
+	})
+
+	It("gives up after MaxAttempts", func() {
+		issuer := failingThenSucceeding(5, &certify.RetryableError{Err: errors.New("sealed")})
+		r := &certify.RetryIssuer{
+			Issuer:         issuer,
+			MaxAttempts:    2,
+			InitialBackoff: time.Millisecond,
+		}
+
+		_, err := r.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+		Expect(err).To(MatchError("sealed"))
+		Expect(issuer.IssueCalls()).To(HaveLen(2))
+	})
+
+	It("does not retry permanent errors", func() {
+		issuer := failingThenSucceeding(1, &certify.PermanentError{Err: errors.New("permission denied")})
+		r := &certify.RetryIssuer{
+			Issuer:         issuer,
+			InitialBackoff: time.Millisecond,
+		}
+
+		_, err := r.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+		Expect(err).To(MatchError("permission denied"))
+		Expect(issuer.IssueCalls()).To(HaveLen(1))
+	})
+
+	It("stops retrying when the context is done", func() {
+		issuer := failingThenSucceeding(5, &certify.RetryableError{Err: errors.New("sealed")})
+		r := &certify.RetryIssuer{
+			Issuer:         issuer,
+			InitialBackoff: time.Hour,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := r.Issue(ctx, "myserver.com", &certify.CertConfig{})
+		Expect(err).To(MatchError("sealed"))
+		Expect(issuer.IssueCalls()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("IsRetryable", func() {
+	It("classifies errors", func() {
+		Expect(certify.IsRetryable(&certify.RetryableError{Err: errors.New("test")})).To(BeTrue())
+		Expect(certify.IsRetryable(&net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}})).To(BeTrue())
+		Expect(certify.IsRetryable(&net.OpError{Op: "read", Err: syscall.ECONNRESET})).To(BeTrue())
+		Expect(certify.IsRetryable(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})).To(BeFalse())
+		Expect(certify.IsRetryable(&certify.PermanentError{Err: &net.OpError{Op: "dial", Err: errors.New("test")}})).To(BeFalse())
+		Expect(certify.IsRetryable(context.DeadlineExceeded)).To(BeFalse())
+		Expect(certify.IsRetryable(errors.New("test"))).To(BeFalse())
+		Expect(certify.IsRetryable(nil)).To(BeFalse())
+	})
+
+	It("doesn't retry failures to verify the certificate of the server", func() {
+		issuer := &mocks.IssuerMock{
+			IssueFunc: func(context.Context, string, *certify.CertConfig) (*tls.Certificate, error) {
+				return nil, &url.Error{
+					Op:  "Post",
+					URL: "https://vault.example.com/v1/pki/issue/role",
+					Err: x509.UnknownAuthorityError{},
+				}
+			},
+		}
+		r := &certify.RetryIssuer{
+			Issuer:         issuer,
+			InitialBackoff: time.Millisecond,
+		}
+
+		_, err := r.Issue(context.Background(), "myserver.com", &certify.CertConfig{})
+		Expect(err).To(HaveOccurred())
+		Expect(issuer.IssueCalls()).To(HaveLen(1))
+	})
+})
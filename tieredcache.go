@@ -0,0 +1,163 @@
+package certify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// negativeCacheTTL is how long TieredCache remembers
+// that a certificate wasn't found in any layer.
+const negativeCacheTTL = 5 * time.Second
+
+// skipNegativeCacheKey is the context key of the flag making
+// TieredCache look a certificate up in its layers, even if it
+// recently wasn't found.
+type skipNegativeCacheKey struct{}
+
+// skipNegativeCache returns a context for looking up certificates
+// that may have been stored by another instance since they were
+// last looked up, such as after acquiring the Locker.
+func skipNegativeCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipNegativeCacheKey{}, true)
+}
+
+type tieredCache struct {
+	layers []Cache
+
+	mu     sync.Mutex
+	misses map[string]time.Time
+	// gen is incremented on every write, so a miss
+	// isn't remembered if a write raced with it.
+	gen uint64
+}
+
+// TieredCache creates a Cache composed of layers, ordered from the
+// fastest to the slowest, for example an in-memory cache in front of
+// a cache shared between instances, such as DirCache on a shared
+// volume or the Redis cache:
+//
+//	cache := certify.TieredCache(certify.NewMemCache(), certify.DirCache("certificates"))
+//
+// Get tries each layer in order, and on a hit in a lower layer, puts
+// the certificate in the layers above it. Failures of a layer are
+// skipped over, and only returned if no layer has the certificate.
+// If no layer has the certificate, ErrCacheMiss is returned, and
+// remembered for a few seconds, so repeated lookups of missing
+// certificates don't all reach the lower layers. When a Locker is
+// configured, Certify bypasses remembered misses when it checks the
+// cache again after acquiring the lock, so it finds certificates
+// issued by other instances in the meantime.
+//
+// Put writes through to all layers, starting with the lowest, and
+// Delete deletes from all layers. Both carry on if a layer fails,
+// and return the last error.
+func TieredCache(layers ...Cache) Cache {
+	return &tieredCache{
+		layers: layers,
+		misses: map[string]time.Time{},
+	}
+}
+
+func (t *tieredCache) Get(ctx context.Context, key string) (*tls.Certificate, error) {
+	gen, missed := t.missed(key)
+	if missed && ctx.Value(skipNegativeCacheKey{}) == nil {
+		return nil, ErrCacheMiss
+	}
+
+	var firstErr error
+	for i, layer := range t.layers {
+		cert, err := layer.Get(ctx, key)
+		if err != nil {
+			// Keep the first failure or unusable certificate, which
+			// is more useful than a plain miss in a lower layer.
+			if firstErr == nil && err != ErrCacheMiss {
+				firstErr = fmt.Errorf("layer %d: %w", i, err)
+			}
+			continue
+		}
+
+		// Populate the layers above, on a best effort basis
+		for _, upper := range t.layers[:i] {
+			_ = upper.Put(ctx, key, cert)
+		}
+		return cert, nil
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	t.remember(key, gen)
+	return nil, ErrCacheMiss
+}
+
+func (t *tieredCache) Put(ctx context.Context, key string, cert *tls.Certificate) error {
+	t.forget(key)
+	// Also after writing, in case of concurrent misses
+	defer t.forget(key)
+
+	var err error
+	for i := len(t.layers) - 1; i >= 0; i-- {
+		if e := t.layers[i].Put(ctx, key, cert); e != nil {
+			err = fmt.Errorf("layer %d: %w", i, e)
+		}
+	}
+
+	return err
+}
+
+func (t *tieredCache) Delete(ctx context.Context, key string) error {
+	t.forget(key)
+	// Also after writing, in case of concurrent misses
+	defer t.forget(key)
+
+	var err error
+	for i := len(t.layers) - 1; i >= 0; i-- {
+		if e := t.layers[i].Delete(ctx, key); e != nil && !errors.Is(e, ErrCacheMiss) {
+			err = fmt.Errorf("layer %d: %w", i, e)
+		}
+	}
+
+	return err
+}
+
+// missed reports whether the key was recently not
+// found in any layer, and the current generation.
+func (t *tieredCache) missed(key string) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expiry, ok := t.misses[key]
+	return t.gen, ok && time.Now().Before(expiry)
+}
+
+// remember remembers that the key wasn't found in any layer,
+// unless there have been writes since the generation.
+func (t *tieredCache) remember(key string, gen uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if gen != t.gen {
+		return
+	}
+	now := time.Now()
+	for k, expiry := range t.misses {
+		if now.After(expiry) {
+			delete(t.misses, k)
+		}
+	}
+	t.misses[key] = now.Add(negativeCacheTTL)
+}
+
+// forget forgets that the key wasn't found in any layer.
+func (t *tieredCache) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+	delete(t.misses, key)
+}
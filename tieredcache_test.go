@@ -0,0 +1,135 @@
+package certify_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/johanbrandhorst/certify"
+)
+
+// countingCache counts the calls to Get of the wrapped
+// Cache, and optionally fails all operations.
+type countingCache struct {
+	certify.Cache
+	gets int32
+	err  error
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) (*tls.Certificate, error) {
+	atomic.AddInt32(&c.gets, 1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *countingCache) Put(ctx context.Context, key string, cert *tls.Certificate) error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Cache.Put(ctx, key, cert)
+}
+
+func (c *countingCache) Delete(ctx context.Context, key string) error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Cache.Delete(ctx, key)
+}
+
+var _ = Describe("TieredCache", func() {
+	var (
+		upper, lower *countingCache
+		cache        certify.Cache
+		cert         *tls.Certificate
+	)
+
+	BeforeEach(func() {
+		upper = &countingCache{Cache: certify.NewMemCache()}
+		lower = &countingCache{Cache: certify.NewMemCache()}
+		cache = certify.TieredCache(upper, lower)
+		var err error
+		cert, err = generateCertAndKey("localhost", net.IPv4(127, 0, 0, 1), func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		})
+		Expect(err).To(Succeed())
+	})
+
+	It("populates upper layers on hits in lower layers", func() {
+		Expect(lower.Put(context.Background(), "localhost", cert)).To(Succeed())
+
+		cached, err := cache.Get(context.Background(), "localhost")
+		Expect(err).To(Succeed())
+		Expect(cached).To(Equal(cert))
+		Expect(upper.Cache.Get(context.Background(), "localhost")).To(Equal(cert))
+
+		_, err = cache.Get(context.Background(), "localhost")
+		Expect(err).To(Succeed())
+		Expect(atomic.LoadInt32(&upper.gets)).To(BeEquivalentTo(2))
+		Expect(atomic.LoadInt32(&lower.gets)).To(BeEquivalentTo(1))
+	})
+
+	It("writes through to and deletes from all layers", func() {
+		Expect(cache.Put(context.Background(), "localhost", cert)).To(Succeed())
+		Expect(upper.Cache.Get(context.Background(), "localhost")).To(Equal(cert))
+		Expect(lower.Cache.Get(context.Background(), "localhost")).To(Equal(cert))
+
+		Expect(cache.Delete(context.Background(), "localhost")).To(Succeed())
+		_, err := upper.Cache.Get(context.Background(), "localhost")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+		_, err = lower.Cache.Get(context.Background(), "localhost")
+		Expect(err).To(Equal(certify.ErrCacheMiss))
+	})
+
+	It("remembers misses until the certificate is put", func() {
+		for i := 0; i < 3; i++ {
+			_, err := cache.Get(context.Background(), "localhost")
+			Expect(err).To(Equal(certify.ErrCacheMiss))
+		}
+		Expect(atomic.LoadInt32(&lower.gets)).To(BeEquivalentTo(1))
+
+		Expect(cache.Put(context.Background(), "localhost", cert)).To(Succeed())
+		Expect(cache.Get(context.Background(), "localhost")).To(Equal(cert))
+	})
+
+	It("skips over failing layers", func() {
+		upper.err = errors.New("unavailable")
+		Expect(lower.Put(context.Background(), "localhost", cert)).To(Succeed())
+		Expect(cache.Get(context.Background(), "localhost")).To(Equal(cert))
+
+		_, err := cache.Get(context.Background(), "otherhost")
+		Expect(err).To(MatchError(ContainSubstring("unavailable")))
+		Expect(errors.Is(err, certify.ErrCacheMiss)).To(BeFalse())
+
+		// Failures aren't remembered
+		_, err = cache.Get(context.Background(), "otherhost")
+		Expect(err).To(HaveOccurred())
+		Expect(atomic.LoadInt32(&lower.gets)).To(BeEquivalentTo(3))
+
+		err = cache.Put(context.Background(), "otherhost", cert)
+		Expect(err).To(MatchError(ContainSubstring("unavailable")))
+		Expect(lower.Cache.Get(context.Background(), "otherhost")).To(Equal(cert))
+	})
+
+	It("prefers usable certificates in lower layers over unusable ones", func() {
+		upper.err = fmt.Errorf("%w: corrupt", certify.ErrCacheMiss)
+		Expect(lower.Put(context.Background(), "localhost", cert)).To(Succeed())
+		Expect(cache.Get(context.Background(), "localhost")).To(Equal(cert))
+
+		lower.err = errors.New("unavailable")
+		_, err := cache.Get(context.Background(), "otherhost")
+		Expect(errors.Is(err, certify.ErrCacheMiss)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("corrupt")))
+	})
+})